@@ -0,0 +1,113 @@
+package gcppromd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"google.golang.org/api/cloudasset/v1"
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	assetTypeInstance = "compute.googleapis.com/Instance"
+	// version of the Compute Engine API the instances are decoded from
+	assetInstanceVersion = "v1"
+	assetPageSize        = 500
+)
+
+// AssetDiscovery discovers the GCE instances of a whole organization or folder with the Cloud Asset Inventory,
+// instead of listing the instances of every project.
+type AssetDiscovery struct {
+	service *cloudasset.Service
+}
+
+// NewAssetDiscovery creates a new Cloud Asset Inventory discovery.
+func NewAssetDiscovery() (*AssetDiscovery, error) {
+	ctx := context.Background()
+	cl, err := newClient(ctx, cloudasset.CloudPlatformScope)
+	if err != nil {
+		return nil, err
+	}
+
+	service, err := cloudasset.New(cl)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AssetDiscovery{service: service}, nil
+}
+
+// ValidateAssetScope checks that scope is an organizations/<number> or folders/<number> scope.
+func ValidateAssetScope(scope string) error {
+	for _, prefix := range []string{"organizations/", "folders/"} {
+		if strings.HasPrefix(scope, prefix) && len(scope) > len(prefix) && !strings.Contains(scope[len(prefix):], "/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid asset scope %q, expected organizations/<id> or folders/<id>", scope)
+}
+
+// Instances returns the targets of the instances of an organization or folder scope carrying the presence label,
+// with the same labels as GCEDiscovery.Instances except for the managed instance groups ones.
+func (d *AssetDiscovery) Instances(ctx context.Context, scope string, opts DiscoveryOptions) ([]*PromConfig, error) {
+	req := d.service.V1.SearchAllResources(scope).
+		AssetTypes(assetTypeInstance).
+		ReadMask("name,versionedResources").
+		PageSize(assetPageSize)
+	if !opts.DisablePresenceFilter {
+		// label existence query, the value is matched below
+		req = req.Query(fmt.Sprintf("labels.%s:*", opts.presenceLabel()))
+	}
+
+	configs := make([]*PromConfig, 0, 100)
+	// the delegated hosts are declared per project, like the gce source does
+	delagatedHosts := make(map[string]map[string]*delagatedHost)
+	err := req.Pages(ctx, func(r *cloudasset.SearchAllResourcesResponse) error {
+		for _, result := range r.Results {
+			project, inst, err := assetInstance(result)
+			if err != nil {
+				return err
+			}
+			if inst == nil || !opts.matchesPresence(inst.Labels) {
+				continue
+			}
+			if delagatedHosts[project] == nil {
+				delagatedHosts[project] = make(map[string]*delagatedHost)
+			}
+			configs = append(configs, instanceConfigs(project, inst, opts, nil, delagatedHosts[project])...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, hosts := range delagatedHosts {
+		configs = append(configs, delegatedConfigs(hosts)...)
+	}
+	return configs, nil
+}
+
+// assetInstance decodes an instance and the ID of its project from a search result, the instance is nil when the
+// result has no resource of the expected version.
+func assetInstance(result *cloudasset.ResourceSearchResult) (string, *compute.Instance, error) {
+	// the name of an instance is //compute.googleapis.com/projects/<project>/zones/<zone>/instances/<name>
+	segments := strings.Split(result.Name, "/")
+	if len(segments) != 9 || segments[3] != "projects" {
+		return "", nil, fmt.Errorf("unexpected instance asset name %s", result.Name)
+	}
+	project := segments[4]
+
+	for _, versioned := range result.VersionedResources {
+		if versioned.Version != assetInstanceVersion {
+			continue
+		}
+		inst := &compute.Instance{}
+		if err := json.Unmarshal(versioned.Resource, inst); err != nil {
+			return "", nil, fmt.Errorf("decoding instance asset %s: %v", result.Name, err)
+		}
+		return project, inst, nil
+	}
+	return project, nil, nil
+}
@@ -0,0 +1,69 @@
+package gcppromd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"google.golang.org/api/cloudasset/v1"
+	"google.golang.org/api/option"
+)
+
+// assetResult returns a search result of an instance declaring the delegated host lb of the project.
+func assetResult(project, name, lbAddress string) string {
+	return fmt.Sprintf(`{
+		"name": "//compute.googleapis.com/projects/%[1]s/zones/europe-west4-a/instances/%[2]s",
+		"versionedResources": [{
+			"version": "v1",
+			"resource": {
+				"name": "%[2]s",
+				"selfLink": "https://www.googleapis.com/compute/v1/projects/%[1]s/zones/europe-west4-a/instances/%[2]s",
+				"zone": "https://www.googleapis.com/compute/v1/projects/%[1]s/zones/europe-west4-a",
+				"labels": {"prometheus": ""},
+				"networkInterfaces": [{"networkIP": "10.0.0.2"}],
+				"metadata": {"items": [
+					{"key": "prometheus_delegate_address_lb", "value": "%[3]s"},
+					{"key": "prometheus_delegate_ports_lb", "value": "9100"}
+				]}
+			}
+		}]
+	}`, project, name, lbAddress)
+}
+
+func TestAssetDiscoveryDelegatedHosts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"results": [%s, %s]}`,
+			assetResult("project-a", "vm-a", "lb-a.example.com"),
+			assetResult("project-b", "vm-b", "lb-b.example.com"))
+	}))
+	defer srv.Close()
+
+	service, err := cloudasset.NewService(context.Background(), option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &AssetDiscovery{service: service}
+	configs, err := d.Instances(context.Background(), "organizations/1", DiscoveryOptions{})
+	if err != nil {
+		t.Fatalf("Instances() = %v", err)
+	}
+
+	var delegated []string
+	for _, config := range configs {
+		if _, ok := config.Labels[promLabelDelegateForNames]; !ok {
+			continue
+		}
+		delegated = append(delegated, fmt.Sprintf("%v %s", config.Targets, config.Labels[promLabelDelegateForNames]))
+	}
+	sort.Strings(delegated)
+	want := []string{
+		"[lb-a.example.com:9100] ,https://www.googleapis.com/compute/v1/projects/project-a/zones/europe-west4-a/instances/vm-a,",
+		"[lb-b.example.com:9100] ,https://www.googleapis.com/compute/v1/projects/project-b/zones/europe-west4-a/instances/vm-b,",
+	}
+	if fmt.Sprint(delegated) != fmt.Sprint(want) {
+		t.Errorf("delegated hosts = %v, want %v", delegated, want)
+	}
+}
@@ -0,0 +1,185 @@
+package gcppromd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+	pstrutil "github.com/prometheus/prometheus/util/strutil"
+	"google.golang.org/api/option"
+	"google.golang.org/api/run/v1"
+)
+
+const (
+	// Label names generated for the Cloud Run services
+	promLabelCloudRun          = pmodel.MetaLabelPrefix + "cloudrun_"
+	promLabelCloudRunProject   = promLabelCloudRun + "project"
+	promLabelCloudRunService   = promLabelCloudRun + "service"
+	promLabelCloudRunRegion    = promLabelCloudRun + "region"
+	promLabelCloudRunRevision  = promLabelCloudRun + "revision"
+	promLabelCloudRunIngress   = promLabelCloudRun + "ingress"
+	promLabelCloudRunURL       = promLabelCloudRun + "url"
+	promLabelCloudRunLabel     = promLabelCloudRun + "label_"
+	cloudRunIngressAnnotation  = "run.googleapis.com/ingress"
+	cloudRunRegionalEndpoint   = "https://%s-run.googleapis.com/"
+	cloudRunDefaultHTTPSPort   = "443"
+	cloudRunServicesPageLength = 500
+	// how long the regions of a project, and the ones where Cloud Run is unavailable, are cached
+	cloudRunRegionsTTL = 10 * time.Minute
+)
+
+// CloudRunDiscovery discovers the Cloud Run services.
+type CloudRunDiscovery struct {
+	client  *http.Client
+	service *run.APIService
+
+	mu      sync.Mutex
+	regions map[string]*cloudRunRegions
+}
+
+// cloudRunRegions are the Cloud Run regions of a project, the regions where Cloud Run is unavailable for the project
+// are skipped until the regions are listed again.
+type cloudRunRegions struct {
+	regions     []string
+	unavailable map[string]bool
+	updated     time.Time
+}
+
+// NewCloudRunDiscovery creates a new Cloud Run discovery.
+func NewCloudRunDiscovery() (*CloudRunDiscovery, error) {
+	ctx := context.Background()
+	cl, err := newClient(ctx, run.CloudPlatformScope)
+	if err != nil {
+		return nil, err
+	}
+
+	service, err := run.NewService(ctx, option.WithHTTPClient(cl))
+	if err != nil {
+		return nil, err
+	}
+
+	return &CloudRunDiscovery{client: cl, service: service, regions: make(map[string]*cloudRunRegions)}, nil
+}
+
+// Services returns a target per Cloud Run service of a project carrying the presence label, in every region. The
+// targets are the host of the URL of the services, scraped over HTTPS. The regions are listed about once per
+// cloudRunRegionsTTL, in between the regions where Cloud Run is unavailable are skipped.
+func (d *CloudRunDiscovery) Services(ctx context.Context, project string, opts DiscoveryOptions) ([]*PromConfig, error) {
+	d.mu.Lock()
+	cached, ok := d.regions[project]
+	d.mu.Unlock()
+	sweep := !ok || time.Since(cached.updated) >= cloudRunRegionsTTL
+	if sweep {
+		regions := make([]string, 0, 40)
+		err := d.service.Projects.Locations.List("projects/"+project).Pages(ctx, func(l *run.ListLocationsResponse) error {
+			for _, location := range l.Locations {
+				regions = append(regions, location.LocationId)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		cached = &cloudRunRegions{regions: regions, unavailable: make(map[string]bool), updated: time.Now()}
+	}
+
+	configs := make([]*PromConfig, 0, 10)
+	for _, region := range cached.regions {
+		if !sweep && cached.unavailable[region] {
+			continue
+		}
+		services, err := d.regionServices(ctx, project, region, opts)
+		if isNotFound(err) {
+			// Cloud Run isn't available in the region for the project
+			if sweep {
+				cached.unavailable[region] = true
+			}
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("region %s: %v", region, err)
+		}
+		for _, service := range services {
+			if config := cloudRunConfig(project, region, service); config != nil {
+				configs = append(configs, config)
+			}
+		}
+	}
+
+	if sweep {
+		d.mu.Lock()
+		d.regions[project] = cached
+		d.mu.Unlock()
+	}
+	return configs, nil
+}
+
+// regionServices lists the services of a region carrying the presence label, the services of a region are only
+// served by its regional endpoint.
+func (d *CloudRunDiscovery) regionServices(ctx context.Context, project, region string, opts DiscoveryOptions) ([]*run.Service, error) {
+	service, err := run.NewService(ctx, option.WithHTTPClient(d.client), option.WithEndpoint(fmt.Sprintf(cloudRunRegionalEndpoint, region)))
+	if err != nil {
+		return nil, err
+	}
+
+	services := make([]*run.Service, 0, 10)
+	next := ""
+	for {
+		req := service.Namespaces.Services.List("namespaces/" + project).Limit(cloudRunServicesPageLength).Context(ctx)
+		if !opts.DisablePresenceFilter {
+			// label existence selector, the value is matched below
+			req = req.LabelSelector(opts.presenceLabel())
+		}
+		if next != "" {
+			req = req.Continue(next)
+		}
+		l, err := req.Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range l.Items {
+			if s.Metadata != nil && opts.matchesPresence(s.Metadata.Labels) {
+				services = append(services, s)
+			}
+		}
+		if l.Metadata == nil || l.Metadata.Continue == "" {
+			return services, nil
+		}
+		next = l.Metadata.Continue
+	}
+}
+
+// cloudRunConfig returns the target of a Cloud Run service, nil when the service has no URL yet.
+func cloudRunConfig(project, region string, service *run.Service) *PromConfig {
+	if service.Status == nil || service.Status.Url == "" {
+		return nil
+	}
+	u, err := url.Parse(service.Status.Url)
+	if err != nil || u.Hostname() == "" {
+		return nil
+	}
+	port := u.Port()
+	if port == "" {
+		port = cloudRunDefaultHTTPSPort
+	}
+
+	labels := pmodel.LabelSet{
+		promLabelCloudRunProject:  pmodel.LabelValue(project),
+		promLabelCloudRunService:  pmodel.LabelValue(service.Metadata.Name),
+		promLabelCloudRunRegion:   pmodel.LabelValue(region),
+		promLabelCloudRunRevision: pmodel.LabelValue(service.Status.LatestReadyRevisionName),
+		promLabelCloudRunIngress:  pmodel.LabelValue(service.Metadata.Annotations[cloudRunIngressAnnotation]),
+		promLabelCloudRunURL:      pmodel.LabelValue(service.Status.Url),
+		pmodel.SchemeLabel:        "https",
+	}
+	for key, value := range service.Metadata.Labels {
+		labels[pmodel.LabelName(promLabelCloudRunLabel+pstrutil.SanitizeLabelName(key))] = pmodel.LabelValue(value)
+	}
+
+	return &PromConfig{Targets: []string{net.JoinHostPort(u.Hostname(), port)}, Labels: labels}
+}
@@ -0,0 +1,131 @@
+package gcppromd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/option"
+	"google.golang.org/api/run/v1"
+)
+
+// hostRewriter sends all the requests to a test server, counting them by original host.
+type hostRewriter struct {
+	target *url.URL
+
+	mu    sync.Mutex
+	hosts map[string]int
+}
+
+func (h *hostRewriter) RoundTrip(r *http.Request) (*http.Response, error) {
+	h.mu.Lock()
+	h.hosts[r.URL.Host]++
+	h.mu.Unlock()
+
+	r = r.Clone(r.Context())
+	r.Header.Set("X-Original-Host", r.URL.Host)
+	r.URL.Scheme, r.URL.Host = h.target.Scheme, h.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func (h *hostRewriter) calls(host string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.hosts[host]
+}
+
+func TestCloudRunServices(t *testing.T) {
+	services := map[string]string{
+		"api": `{
+			"metadata": {"name": "api", "labels": {"prometheus": ""}},
+			"status": {"url": "https://api-xyz-ew.a.run.app", "latestReadyRevisionName": "api-00001"}
+		}`,
+		"web": `{
+			"metadata": {"name": "web", "labels": {"scrape": "yes"}},
+			"status": {"url": "https://web-xyz-ew.a.run.app", "latestReadyRevisionName": "web-00003"}
+		}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Header.Get("X-Original-Host")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/locations"):
+			fmt.Fprint(w, `{"locations": [{"locationId": "europe-west1"}, {"locationId": "europe-west4"}, {"locationId": "me-west1"}]}`)
+		case host == "europe-west1-run.googleapis.com":
+			items := make([]string, 0, len(services))
+			selector := r.URL.Query().Get("labelSelector")
+			for _, name := range []string{"api", "web"} {
+				if selector == "" || strings.Contains(services[name], `"`+selector+`"`) {
+					items = append(items, services[name])
+				}
+			}
+			fmt.Fprintf(w, `{"items": [%s], "metadata": {}}`, strings.Join(items, ","))
+		case host == "europe-west4-run.googleapis.com":
+			fmt.Fprint(w, `{"items": [], "metadata": {}}`)
+		default:
+			http.Error(w, `{"error": {"code": 404, "message": "Location not found"}}`, http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	target, _ := url.Parse(srv.URL)
+	rewriter := &hostRewriter{target: target, hosts: make(map[string]int)}
+	client := &http.Client{Transport: rewriter}
+	service, err := run.NewService(context.Background(), option.WithHTTPClient(client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &CloudRunDiscovery{client: client, service: service, regions: make(map[string]*cloudRunRegions)}
+
+	// jobs discovering the same project with different presence options
+	jobs := []struct {
+		opts    DiscoveryOptions
+		targets []string
+	}{
+		{opts: DiscoveryOptions{}, targets: []string{"api-xyz-ew.a.run.app:443"}},
+		{opts: DiscoveryOptions{PresenceLabel: "scrape"}, targets: []string{"web-xyz-ew.a.run.app:443"}},
+		{opts: DiscoveryOptions{DisablePresenceFilter: true}, targets: []string{"api-xyz-ew.a.run.app:443", "web-xyz-ew.a.run.app:443"}},
+	}
+	for refresh := 1; refresh <= 2; refresh++ {
+		for n, job := range jobs {
+			configs, err := d.Services(context.Background(), "project-a", job.opts)
+			if err != nil {
+				t.Fatalf("refresh #%d, job #%d: Services() = %v", refresh, n, err)
+			}
+			targets := make([]string, 0, len(configs))
+			for _, config := range configs {
+				targets = append(targets, config.Targets...)
+			}
+			if !reflect.DeepEqual(targets, job.targets) {
+				t.Errorf("refresh #%d, job #%d: targets = %v, want %v", refresh, n, targets, job.targets)
+			}
+		}
+	}
+
+	// only the regions where Cloud Run is unavailable are skipped until the regions are listed again
+	want := map[string]int{
+		"run.googleapis.com":              1,
+		"europe-west1-run.googleapis.com": 6,
+		"europe-west4-run.googleapis.com": 6,
+		"me-west1-run.googleapis.com":     1,
+	}
+	for host, calls := range want {
+		if got := rewriter.calls(host); got != calls {
+			t.Errorf("%d calls to %s, want %d", got, host, calls)
+		}
+	}
+
+	d.regions["project-a"].updated = time.Now().Add(-cloudRunRegionsTTL)
+	if _, err := d.Services(context.Background(), "project-a", DiscoveryOptions{}); err != nil {
+		t.Fatalf("Services() = %v", err)
+	}
+	if got := rewriter.calls("me-west1-run.googleapis.com"); got != 2 {
+		t.Errorf("%d calls to me-west1-run.googleapis.com after the regions expired, want 2", got)
+	}
+}
@@ -0,0 +1,135 @@
+package gcppromd
+
+import (
+	"context"
+	"fmt"
+	"text/template"
+
+	pmodel "github.com/prometheus/common/model"
+	pstrutil "github.com/prometheus/prometheus/util/strutil"
+	"google.golang.org/api/sqladmin/v1beta4"
+)
+
+const (
+	// Label names generated for the Cloud SQL instances
+	promLabelCloudSQL                = pmodel.MetaLabelPrefix + "cloudsql_"
+	promLabelCloudSQLProject         = promLabelCloudSQL + "project"
+	promLabelCloudSQLName            = promLabelCloudSQL + "name"
+	promLabelCloudSQLConnectionName  = promLabelCloudSQL + "connection_name"
+	promLabelCloudSQLDatabaseVersion = promLabelCloudSQL + "database_version"
+	promLabelCloudSQLTier            = promLabelCloudSQL + "tier"
+	promLabelCloudSQLRegion          = promLabelCloudSQL + "region"
+	promLabelCloudSQLZone            = promLabelCloudSQL + "zone"
+	promLabelCloudSQLState           = promLabelCloudSQL + "state"
+	promLabelCloudSQLPrivateIP       = promLabelCloudSQL + "private_ip"
+	promLabelCloudSQLPublicIP        = promLabelCloudSQL + "public_ip"
+	promLabelCloudSQLLabel           = promLabelCloudSQL + "label_"
+	// types of the Cloud SQL IP addresses
+	cloudSQLIPPrivate = "PRIVATE"
+	cloudSQLIPPublic  = "PRIMARY"
+)
+
+// CloudSQLInstance is the data the Cloud SQL exporter address template is executed with.
+type CloudSQLInstance struct {
+	Project         string
+	Name            string
+	ConnectionName  string
+	DatabaseVersion string
+	Region          string
+	Zone            string
+	PrivateIP       string
+	PublicIP        string
+}
+
+// CloudSQLDiscovery discovers the Cloud SQL instances.
+type CloudSQLDiscovery struct {
+	service *sqladmin.Service
+}
+
+// NewCloudSQLDiscovery creates a new Cloud SQL discovery.
+func NewCloudSQLDiscovery() (*CloudSQLDiscovery, error) {
+	ctx := context.Background()
+	cl, err := newClient(ctx, sqladmin.CloudPlatformScope)
+	if err != nil {
+		return nil, err
+	}
+
+	service, err := sqladmin.New(cl)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CloudSQLDiscovery{service: service}, nil
+}
+
+// Instances returns a target per Cloud SQL instance of a project. The targets are the address of the exporter given
+// by opts.CloudSQLExporter, with the connection name of the instance as the target URL parameter.
+func (d *CloudSQLDiscovery) Instances(ctx context.Context, project string, opts DiscoveryOptions) ([]*PromConfig, error) {
+	exporter, err := parseExporterAddress("Cloud SQL", opts.CloudSQLExporter, CloudSQLInstance{})
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make([]*PromConfig, 0, 10)
+	err = d.service.Instances.List(project).Pages(ctx, func(l *sqladmin.InstancesListResponse) error {
+		for _, inst := range l.Items {
+			config, err := cloudSQLConfig(project, inst, exporter)
+			if err != nil {
+				return err
+			}
+			configs = append(configs, config)
+		}
+		return nil
+	})
+	return configs, err
+}
+
+// cloudSQLConfig returns the target of a Cloud SQL instance.
+func cloudSQLConfig(project string, inst *sqladmin.DatabaseInstance, exporter *template.Template) (*PromConfig, error) {
+	data := CloudSQLInstance{
+		Project:         project,
+		Name:            inst.Name,
+		ConnectionName:  inst.ConnectionName,
+		DatabaseVersion: inst.DatabaseVersion,
+		Region:          inst.Region,
+		Zone:            inst.GceZone,
+	}
+	for _, ip := range inst.IpAddresses {
+		switch ip.Type {
+		case cloudSQLIPPrivate:
+			data.PrivateIP = ip.IpAddress
+		case cloudSQLIPPublic:
+			data.PublicIP = ip.IpAddress
+		}
+	}
+
+	addr, err := executeExporterAddress(exporter, data)
+	if err != nil {
+		return nil, fmt.Errorf("instance %s: %v", inst.Name, err)
+	}
+
+	labels := pmodel.LabelSet{
+		promLabelCloudSQLProject:           pmodel.LabelValue(project),
+		promLabelCloudSQLName:              pmodel.LabelValue(inst.Name),
+		promLabelCloudSQLConnectionName:    pmodel.LabelValue(inst.ConnectionName),
+		promLabelCloudSQLDatabaseVersion:   pmodel.LabelValue(inst.DatabaseVersion),
+		promLabelCloudSQLRegion:            pmodel.LabelValue(inst.Region),
+		promLabelCloudSQLZone:              pmodel.LabelValue(inst.GceZone),
+		promLabelCloudSQLState:             pmodel.LabelValue(inst.State),
+		pmodel.ParamLabelPrefix + "target": pmodel.LabelValue(inst.ConnectionName),
+	}
+	if data.PrivateIP != "" {
+		labels[promLabelCloudSQLPrivateIP] = pmodel.LabelValue(data.PrivateIP)
+	}
+	if data.PublicIP != "" {
+		labels[promLabelCloudSQLPublicIP] = pmodel.LabelValue(data.PublicIP)
+	}
+	if inst.Settings != nil {
+		labels[promLabelCloudSQLTier] = pmodel.LabelValue(inst.Settings.Tier)
+		for key, value := range inst.Settings.UserLabels {
+			labels[pmodel.LabelName(promLabelCloudSQLLabel+pstrutil.SanitizeLabelName(key))] = pmodel.LabelValue(value)
+		}
+	}
+
+	return &PromConfig{Targets: []string{addr}, Labels: labels}, nil
+}
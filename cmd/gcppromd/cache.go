@@ -0,0 +1,79 @@
+package main
+
+import (
+	"time"
+
+	"github.com/messagebird/gcppromd"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// targetsCache keeps the last known good targets of every project and source, they replace the targets of a project
+// for which the discovery fails until they are older than maxAge.
+type targetsCache struct {
+	output  string
+	maxAge  time.Duration
+	entries map[string]*targetsCacheEntry
+}
+
+type targetsCacheEntry struct {
+	configs []*gcppromd.PromConfig
+	updated time.Time
+}
+
+func newTargetsCache(output string, maxAge time.Duration) *targetsCache {
+	return &targetsCache{
+		output:  output,
+		maxAge:  maxAge,
+		entries: make(map[string]*targetsCacheEntry),
+	}
+}
+
+// update records the targets of the discovered projects and returns the targets to write, falling back to the last
+// known targets of the projects that failed.
+func (c *targetsCache) update(results []*projectTargets, now time.Time) []*gcppromd.PromConfig {
+	configs := make([]*gcppromd.PromConfig, 0, 100)
+	seen := make(map[string]bool, len(results))
+	stale := 0
+	for _, result := range results {
+		key := result.Project + "/" + result.Source
+		seen[key] = true
+		if result.Err == nil {
+			c.entries[key] = &targetsCacheEntry{configs: result.Configs, updated: now}
+			configs = append(configs, result.Configs...)
+			continue
+		}
+
+		entry, has := c.entries[key]
+		if !has {
+			continue
+		}
+		age := now.Sub(entry.updated)
+		if age > c.maxAge {
+			log.WithFields(log.Fields{
+				"project": result.Project,
+				"source":  result.Source,
+				"age":     age,
+			}).Warn("last known targets are too old, dropping them")
+			delete(c.entries, key)
+			continue
+		}
+		log.WithFields(log.Fields{
+			"project": result.Project,
+			"source":  result.Source,
+			"age":     age,
+		}).Warn("discovery failed, using the last known targets")
+		configs = append(configs, entry.configs...)
+		stale++
+	}
+
+	// forget the projects and sources that are not discovered anymore
+	for key := range c.entries {
+		if !seen[key] {
+			delete(c.entries, key)
+		}
+	}
+	daemonStaleProjects.WithLabelValues(c.output).Set(float64(stale))
+
+	return configs
+}
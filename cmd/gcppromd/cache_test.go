@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/messagebird/gcppromd"
+)
+
+func targetsOf(configs []*gcppromd.PromConfig) []string {
+	targets := make([]string, 0, len(configs))
+	for _, config := range configs {
+		targets = append(targets, config.Targets...)
+	}
+	return targets
+}
+
+func discovered(project, source string, targets ...string) *projectTargets {
+	configs := make([]*gcppromd.PromConfig, 0, len(targets))
+	for _, target := range targets {
+		configs = append(configs, &gcppromd.PromConfig{Targets: []string{target}})
+	}
+	return &projectTargets{Project: project, Source: source, Configs: configs}
+}
+
+func failed(project, source string) *projectTargets {
+	return &projectTargets{Project: project, Source: source, Err: errors.New("permission denied")}
+}
+
+func TestTargetsCache(t *testing.T) {
+	t0 := time.Date(2021, 3, 4, 5, 0, 0, 0, time.UTC)
+	c := newTargetsCache("targets.json", 10*time.Minute)
+
+	steps := []struct {
+		name    string
+		now     time.Time
+		results []*projectTargets
+		want    []string
+		entries int
+	}{
+		{
+			name:    "discovered",
+			now:     t0,
+			results: []*projectTargets{discovered("a", "gce", "a1"), discovered("b", "gce", "b1"), discovered("b", "gke", "b2")},
+			want:    []string{"a1", "b1", "b2"},
+			entries: 3,
+		},
+		{
+			name:    "failed project uses the last known targets",
+			now:     t0.Add(5 * time.Minute),
+			results: []*projectTargets{discovered("a", "gce", "a1", "a2"), failed("b", "gce"), discovered("b", "gke", "b2")},
+			want:    []string{"a1", "a2", "b1", "b2"},
+			entries: 3,
+		},
+		{
+			name:    "last known targets kept up to maxAge",
+			now:     t0.Add(10 * time.Minute),
+			results: []*projectTargets{discovered("a", "gce", "a1"), failed("b", "gce"), discovered("b", "gke", "b2")},
+			want:    []string{"a1", "b1", "b2"},
+			entries: 3,
+		},
+		{
+			name:    "last known targets expired",
+			now:     t0.Add(11 * time.Minute),
+			results: []*projectTargets{discovered("a", "gce", "a1"), failed("b", "gce"), discovered("b", "gke", "b2")},
+			want:    []string{"a1", "b2"},
+			entries: 2,
+		},
+		{
+			name:    "project not discovered anymore",
+			now:     t0.Add(12 * time.Minute),
+			results: []*projectTargets{discovered("b", "gke", "b2")},
+			want:    []string{"b2"},
+			entries: 1,
+		},
+		{
+			name:    "forgotten project failing",
+			now:     t0.Add(13 * time.Minute),
+			results: []*projectTargets{failed("a", "gce"), discovered("b", "gke", "b2")},
+			want:    []string{"b2"},
+			entries: 1,
+		},
+		{
+			name:    "unknown project failing",
+			now:     t0.Add(14 * time.Minute),
+			results: []*projectTargets{failed("c", "gce")},
+			want:    []string{},
+			entries: 0,
+		},
+	}
+	for _, step := range steps {
+		got := targetsOf(c.update(step.results, step.now))
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: update() = %v, want %v", step.name, got, step.want)
+		}
+		if len(c.entries) != step.entries {
+			t.Errorf("%s: %d cache entries, want %d", step.name, len(c.entries), step.entries)
+		}
+	}
+}
+
+func TestTargetsCacheDisabled(t *testing.T) {
+	t0 := time.Date(2021, 3, 4, 5, 0, 0, 0, time.UTC)
+	c := newTargetsCache("targets.json", 0)
+	c.update([]*projectTargets{discovered("a", "gce", "a1")}, t0)
+	if got := targetsOf(c.update([]*projectTargets{failed("a", "gce")}, t0.Add(time.Second))); len(got) != 0 {
+		t.Errorf("update() = %v, want no targets with a zero maxAge", got)
+	}
+}
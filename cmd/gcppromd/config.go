@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/messagebird/gcppromd"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the content of the configuration file given with -config, a YAML or JSON document.
+type Config struct {
+	Jobs []*JobConfig `yaml:"jobs"`
+}
+
+// JobConfig describes a discovery job of the daemon, each job writes its own output file.
+type JobConfig struct {
+	Name                  string   `yaml:"name"`
+	Projects              []string `yaml:"projects"`
+	ProjectsAutoDiscovery bool     `yaml:"projects_auto_discovery"`
+	ProjectsIncludes      string   `yaml:"projects_includes"`
+	ProjectsExcludes      string   `yaml:"projects_excludes"`
+	ProjectsParents       []string `yaml:"projects_parents"`
+	ProjectsLabels        string   `yaml:"projects_labels"`
+	ProjectsStates        []string `yaml:"projects_states"`
+	Sources               []string `yaml:"sources"`
+	AssetScopes           []string `yaml:"asset_scopes"`
+	FeedSubscription      string   `yaml:"feed_subscription"`
+	// Filter passed to the GCE API when looking up instances
+	Filter    string         `yaml:"filter"`
+	Output    string         `yaml:"output"`
+	Frequency model.Duration `yaml:"frequency"`
+
+	PresenceLabel  string `yaml:"presence_label"`
+	PresenceValue  string `yaml:"presence_value"`
+	PresenceFilter bool   `yaml:"presence_filter"`
+	AddressFamily  string `yaml:"address_family"`
+	AddressMode    string `yaml:"address_mode"`
+	// GKEPorts are the ports scraped on the GKE nodes by name, the -gke-ports flag when not set
+	GKEPorts            map[string]int `yaml:"gke_ports"`
+	CloudSQLExporter    string         `yaml:"cloudsql_exporter"`
+	MemorystoreExporter string         `yaml:"memorystore_exporter"`
+
+	StaleTargetsMaxAge       model.Duration `yaml:"stale_targets_max_age"`
+	MaxTargetsDropPercent    float64        `yaml:"max_targets_drop_percent"`
+	MaxTargetsDrop           int            `yaml:"max_targets_drop"`
+	TargetsDropOverrideAfter int            `yaml:"targets_drop_override_after"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface, the settings that are not set by the job default to the
+// value of their command line flag.
+func (c *JobConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = JobConfig{
+		Frequency:                model.Duration(time.Second * time.Duration(*fdiscovery)),
+		ProjectsStates:           strings.Split(*fprojectsstates, projectSeparator),
+		Sources:                  strings.Split(*fsources, projectSeparator),
+		PresenceLabel:            *fpresencelabel,
+		PresenceValue:            *fpresencevalue,
+		PresenceFilter:           *fpresencefilter,
+		AddressFamily:            *faddressfamily,
+		AddressMode:              *faddressmode,
+		CloudSQLExporter:         *fcloudsqlexporter,
+		MemorystoreExporter:      *fredisexporter,
+		StaleTargetsMaxAge:       model.Duration(time.Second * time.Duration(*fstaletargets)),
+		MaxTargetsDropPercent:    *fmaxdroppercent,
+		MaxTargetsDrop:           *fmaxdrop,
+		TargetsDropOverrideAfter: *fdropoverride,
+	}
+	type plain JobConfig
+	return unmarshal((*plain)(c))
+}
+
+// loadConfigFile reads and validates a configuration file.
+func loadConfigFile(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if len(cfg.Jobs) == 0 {
+		return nil, fmt.Errorf("no jobs declared in %s", path)
+	}
+
+	names := make(map[string]bool, len(cfg.Jobs))
+	outputs := make(map[string]bool, len(cfg.Jobs))
+	for n, job := range cfg.Jobs {
+		if job.Name == "" {
+			return nil, fmt.Errorf("job #%d has no name", n)
+		}
+		if names[job.Name] {
+			return nil, fmt.Errorf("duplicated job name %q", job.Name)
+		}
+		names[job.Name] = true
+		if job.Output == "" {
+			return nil, fmt.Errorf("job %q has no output", job.Name)
+		}
+		if outputs[job.Output] {
+			return nil, fmt.Errorf("job %q: output %s is already written by another job", job.Name, job.Output)
+		}
+		outputs[job.Output] = true
+		if job.Frequency <= 0 {
+			return nil, fmt.Errorf("job %q: frequency must be positive", job.Name)
+		}
+	}
+	return cfg, nil
+}
+
+// flagsJobConfig returns the job configured by the command line flags.
+func flagsJobConfig() *JobConfig {
+	return &JobConfig{
+		Name:                     "default",
+		Projects:                 projectsSetList(parseProjectsSet(*fprojects)),
+		ProjectsAutoDiscovery:    *fprojectsauto,
+		ProjectsIncludes:         *fprojectsincludes,
+		ProjectsExcludes:         *fprojectsexcludes,
+		ProjectsParents:          projectsSetList(parseProjectsSet(*fprojectsparents)),
+		ProjectsLabels:           *fprojectslabels,
+		ProjectsStates:           strings.Split(*fprojectsstates, projectSeparator),
+		Sources:                  strings.Split(*fsources, projectSeparator),
+		AssetScopes:              projectsSetList(parseProjectsSet(*fassetscopes)),
+		FeedSubscription:         *ffeedsubscription,
+		Filter:                   *ffilter,
+		PresenceLabel:            *fpresencelabel,
+		PresenceValue:            *fpresencevalue,
+		PresenceFilter:           *fpresencefilter,
+		AddressFamily:            *faddressfamily,
+		AddressMode:              *faddressmode,
+		CloudSQLExporter:         *fcloudsqlexporter,
+		MemorystoreExporter:      *fredisexporter,
+		Output:                   *fouput,
+		Frequency:                model.Duration(time.Second * time.Duration(*fdiscovery)),
+		StaleTargetsMaxAge:       model.Duration(time.Second * time.Duration(*fstaletargets)),
+		MaxTargetsDropPercent:    *fmaxdroppercent,
+		MaxTargetsDrop:           *fmaxdrop,
+		TargetsDropOverrideAfter: *fdropoverride,
+	}
+}
+
+// daemonConfig converts the job into the configuration of the daemon running it.
+func (c *JobConfig) daemonConfig() (DaemonConfig, error) {
+	var pincludes *regexp.Regexp
+	if c.ProjectsIncludes != "" {
+		var err error
+		pincludes, err = regexp.Compile(c.ProjectsIncludes)
+		if err != nil {
+			return DaemonConfig{}, fmt.Errorf("job %q: invalid project include pattern: %v", c.Name, err)
+		}
+	}
+
+	var pexcludes *regexp.Regexp
+	if c.ProjectsExcludes != "" {
+		var err error
+		pexcludes, err = regexp.Compile(c.ProjectsExcludes)
+		if err != nil {
+			return DaemonConfig{}, fmt.Errorf("job %q: invalid project exclude pattern: %v", c.Name, err)
+		}
+	}
+
+	plabels, err := gcppromd.ParseLabelSelectors(c.ProjectsLabels)
+	if err == nil {
+		err = validateProjectsAutoDiscovery(c.ProjectsAutoDiscovery, c.ProjectsParents, plabels)
+	}
+	var pstates []string
+	if err == nil {
+		pstates, err = gcppromd.ParseProjectStates(strings.Join(c.ProjectsStates, projectSeparator))
+	}
+	if err != nil {
+		return DaemonConfig{}, fmt.Errorf("job %q: %v", c.Name, err)
+	}
+
+	if err := gcppromd.ValidateFilter(c.Filter); err != nil {
+		return DaemonConfig{}, fmt.Errorf("job %q: %v", c.Name, err)
+	}
+	sources := parseSources(strings.Join(c.Sources, projectSeparator))
+	gkePorts := c.GKEPorts
+	if gkePorts == nil {
+		var err error
+		if gkePorts, err = gcppromd.ParseNamedPorts(*fgkeports); err != nil {
+			return DaemonConfig{}, fmt.Errorf("invalid -gke-ports flag: %v", err)
+		}
+	}
+	opts := gcppromd.DiscoveryOptions{
+		PresenceLabel:         c.PresenceLabel,
+		PresenceValue:         c.PresenceValue,
+		DisablePresenceFilter: !c.PresenceFilter,
+		AddressFamily:         c.AddressFamily,
+		AddressMode:           c.AddressMode,
+		GKEPorts:              gkePorts,
+		CloudSQLExporter:      c.CloudSQLExporter,
+		MemorystoreExporter:   c.MemorystoreExporter,
+	}
+	err = opts.Validate()
+	if err == nil {
+		err = opts.ValidateSources(sources)
+	}
+	if err == nil {
+		err = validateAssetScopes(sources, c.AssetScopes, c.Filter)
+	}
+	if err == nil {
+		err = validateFeedSubscription(c.FeedSubscription, sources, c.Filter)
+	}
+	if err != nil {
+		return DaemonConfig{}, fmt.Errorf("job %q: %v", c.Name, err)
+	}
+
+	return DaemonConfig{
+		Name:                     c.Name,
+		Output:                   c.Output,
+		Frequency:                time.Duration(c.Frequency),
+		Projects:                 projectsSetAdd(ProjectsSet{}, c.Projects),
+		ProjectsIncludePattern:   pincludes,
+		ProjectsExcludePattern:   pexcludes,
+		ProjectsAutoDiscovery:    c.ProjectsAutoDiscovery,
+		ProjectsParents:          c.ProjectsParents,
+		ProjectsLabels:           plabels,
+		ProjectsStates:           pstates,
+		Sources:                  sources,
+		AssetScopes:              c.AssetScopes,
+		FeedSubscription:         c.FeedSubscription,
+		Filter:                   c.Filter,
+		Options:                  opts,
+		StaleTargetsMaxAge:       time.Duration(c.StaleTargetsMaxAge),
+		MaxTargetsDropPercent:    c.MaxTargetsDropPercent,
+		MaxTargetsDrop:           c.MaxTargetsDrop,
+		TargetsDropOverrideAfter: c.TargetsDropOverrideAfter,
+	}, nil
+}
+
+// loadDaemonConfigs returns the configuration of the daemon jobs, read from the configuration file when one is
+// given, from the command line flags otherwise.
+func loadDaemonConfigs() ([]DaemonConfig, error) {
+	jobs := []*JobConfig{flagsJobConfig()}
+	if *fconfig != "" {
+		cfg, err := loadConfigFile(*fconfig)
+		if err != nil {
+			return nil, err
+		}
+		jobs = cfg.Jobs
+	}
+
+	cfgs := make([]DaemonConfig, 0, len(jobs))
+	for _, job := range jobs {
+		cfg, err := job.daemonConfig()
+		if err != nil {
+			return nil, err
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	return cfgs, nil
+}
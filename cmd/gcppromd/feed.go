@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/messagebird/gcppromd"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// feedEventsBuffer is the number of feed events waiting to be applied to the targets of a job
+	feedEventsBuffer = 100
+	// feedRetryDelay is the delay before pulling a feed subscription again after a failure
+	feedRetryDelay = 10 * time.Second
+)
+
+// newFeedSubscription creates the subscription of a feed, it can be replaced to pull a fake feed.
+var newFeedSubscription = gcppromd.NewPubSubSubscription
+
+// watchFeed sends the instance changes published by the Cloud Asset Inventory feed of a job to events, until ctx is
+// done. The subscription is pulled again after feedRetryDelay when it fails.
+func watchFeed(ctx context.Context, logger *log.Entry, cfg DaemonConfig, events chan<- *gcppromd.InstanceEvent) {
+	logger = logger.WithField("subscription", cfg.FeedSubscription)
+	handle := func(event *gcppromd.InstanceEvent, err error) {
+		if err != nil {
+			logger.WithError(err).Warn("ignored invalid feed message")
+			return
+		}
+		select {
+		case events <- event:
+		case <-ctx.Done():
+		}
+	}
+
+	for {
+		sub, err := newFeedSubscription(ctx, cfg.FeedSubscription)
+		if err == nil {
+			err = gcppromd.WatchAssetFeed(ctx, sub, cfg.Options, handle)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		logger.WithError(err).Errorf("feed subscription failed, retrying in %v", feedRetryDelay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(feedRetryDelay):
+		}
+	}
+}
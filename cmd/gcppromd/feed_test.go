@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/messagebird/gcppromd"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fakeSubscription is a gcppromd.FeedSubscription returning its messages on the first pull.
+type fakeSubscription struct {
+	messages []*gcppromd.FeedMessage
+}
+
+func (s *fakeSubscription) Pull(ctx context.Context) ([]*gcppromd.FeedMessage, error) {
+	if messages := s.messages; len(messages) > 0 {
+		s.messages = nil
+		return messages, nil
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (s *fakeSubscription) Acknowledge(ctx context.Context, ackIDs []string) error {
+	return nil
+}
+
+func TestWatchFeed(t *testing.T) {
+	const subscription = "projects/monitoring/subscriptions/gcppromd"
+	message := `{
+		"asset": {
+			"name": "//compute.googleapis.com/projects/project-a/zones/europe-west4-a/instances/vm-1",
+			"assetType": "compute.googleapis.com/Instance"
+		},
+		"window": {"startTime": "2021-03-04T05:06:07Z"},
+		"deleted": true
+	}`
+	defer func(create func(context.Context, string) (gcppromd.FeedSubscription, error)) {
+		newFeedSubscription = create
+	}(newFeedSubscription)
+	newFeedSubscription = func(ctx context.Context, name string) (gcppromd.FeedSubscription, error) {
+		if name != subscription {
+			t.Errorf("subscription %s, want %s", name, subscription)
+		}
+		return &fakeSubscription{messages: []*gcppromd.FeedMessage{{AckID: "1", Data: []byte(message)}}}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan *gcppromd.InstanceEvent, 1)
+	cfg := DaemonConfig{Name: "test", FeedSubscription: subscription}
+	go watchFeed(ctx, log.WithField("job", cfg.Name), cfg, events)
+
+	select {
+	case event := <-events:
+		if event.Key() != "project-a/europe-west4-a/vm-1" || !event.Deleted {
+			t.Errorf("event = %+v, want the deletion of vm-1", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+}
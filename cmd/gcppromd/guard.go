@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/messagebird/gcppromd"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// shrinkGuard protects an output file against being replaced by a drastically shrunken targets list, as it happens
+// when the credentials lose access to some projects. A shrunken list is only accepted once it has been discovered by
+// overrideAfter consecutive refreshes.
+type shrinkGuard struct {
+	output         string
+	maxDropPercent float64
+	maxDrop        int
+	overrideAfter  int
+
+	// previous number of targets written, -1 when unknown
+	previous int
+	// consecutive refusals of the same number of targets
+	refusals     int
+	refusedCount int
+}
+
+// newShrinkGuard creates a guard for the output file of the daemon, the number of targets of the current output
+// file, if any, is used as the reference for the first refresh.
+func newShrinkGuard(cfg DaemonConfig) *shrinkGuard {
+	return &shrinkGuard{
+		output:         cfg.Output,
+		maxDropPercent: cfg.MaxTargetsDropPercent,
+		maxDrop:        cfg.MaxTargetsDrop,
+		overrideAfter:  cfg.TargetsDropOverrideAfter,
+		previous:       countFileTargets(cfg.Output),
+	}
+}
+
+// countFileTargets returns the number of targets in a targets file, -1 if it can't be read.
+func countFileTargets(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return -1
+	}
+	defer f.Close()
+
+	var configs []*gcppromd.PromConfig
+	if err := json.NewDecoder(f).Decode(&configs); err != nil {
+		return -1
+	}
+	return gcppromd.CountTargets(configs)
+}
+
+// allow tells if a targets list of count targets can replace the output file.
+func (g *shrinkGuard) allow(count int) bool {
+	if g.previous < 0 || count >= g.previous {
+		g.refusals = 0
+		return true
+	}
+
+	drop := g.previous - count
+	percent := float64(drop) * 100 / float64(g.previous)
+	if !(g.maxDrop > 0 && drop > g.maxDrop) && !(g.maxDropPercent > 0 && percent > g.maxDropPercent) {
+		g.refusals = 0
+		return true
+	}
+
+	if g.refusals > 0 && count == g.refusedCount {
+		g.refusals++
+	} else {
+		g.refusals = 1
+		g.refusedCount = count
+	}
+
+	fields := log.Fields{
+		"file":     g.output,
+		"previous": g.previous,
+		"targets":  count,
+		"refusals": g.refusals,
+	}
+	if g.overrideAfter > 0 && g.refusals >= g.overrideAfter {
+		log.WithFields(fields).Warn("targets drop confirmed by consecutive refreshes, replacing the output file")
+		return true
+	}
+
+	log.WithFields(fields).Error("targets dropped too much since the previous write, not replacing the output file")
+	daemonRefusedWrites.WithLabelValues(g.output).Inc()
+	daemonConsecutiveRefusals.WithLabelValues(g.output).Set(float64(g.refusals))
+	return false
+}
+
+// allowEvent tells if a targets list updated by a feed event can replace the output file. An event changes a single
+// instance, it is only refused while the targets of the refreshes are refused, and it doesn't count as a refresh
+// towards overrideAfter.
+func (g *shrinkGuard) allowEvent() bool {
+	return g.refusals == 0
+}
+
+// written records that count targets were written to the output file.
+func (g *shrinkGuard) written(count int) {
+	g.previous = count
+	g.refusals = 0
+	daemonConsecutiveRefusals.WithLabelValues(g.output).Set(0)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShrinkGuard(t *testing.T) {
+	type refresh struct {
+		count int
+		allow bool
+	}
+	tests := []struct {
+		name           string
+		maxDropPercent float64
+		maxDrop        int
+		overrideAfter  int
+		previous       int
+		refreshes      []refresh
+	}{
+		{
+			name:      "unknown previous count",
+			maxDrop:   1,
+			previous:  -1,
+			refreshes: []refresh{{0, true}, {10, true}, {8, false}},
+		},
+		{
+			name:      "disabled",
+			previous:  100,
+			refreshes: []refresh{{0, true}},
+		},
+		{
+			name:           "percent threshold",
+			maxDropPercent: 20,
+			previous:       100,
+			refreshes:      []refresh{{80, true}, {63, false}, {64, true}, {120, true}},
+		},
+		{
+			name:      "absolute threshold",
+			maxDrop:   5,
+			previous:  100,
+			refreshes: []refresh{{95, true}, {89, false}, {90, true}},
+		},
+		{
+			name:           "both thresholds",
+			maxDropPercent: 50,
+			maxDrop:        5,
+			previous:       100,
+			refreshes:      []refresh{{90, false}, {40, false}, {96, true}},
+		},
+		{
+			name:          "override after identical refusals",
+			maxDrop:       5,
+			overrideAfter: 3,
+			previous:      100,
+			refreshes:     []refresh{{50, false}, {50, false}, {50, true}, {48, true}, {40, false}},
+		},
+		{
+			name:          "refusals reset when the count changes",
+			maxDrop:       5,
+			overrideAfter: 2,
+			previous:      100,
+			refreshes:     []refresh{{50, false}, {51, false}, {50, false}, {50, true}},
+		},
+		{
+			name:          "refusals reset by an accepted count",
+			maxDrop:       5,
+			overrideAfter: 2,
+			previous:      100,
+			refreshes:     []refresh{{50, false}, {100, true}, {50, false}, {50, true}},
+		},
+		{
+			name:      "never overridden",
+			maxDrop:   5,
+			previous:  100,
+			refreshes: []refresh{{50, false}, {50, false}, {50, false}, {50, false}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &shrinkGuard{
+				output:         "targets.json",
+				maxDropPercent: tt.maxDropPercent,
+				maxDrop:        tt.maxDrop,
+				overrideAfter:  tt.overrideAfter,
+				previous:       tt.previous,
+			}
+			for n, r := range tt.refreshes {
+				if got := g.allow(r.count); got != r.allow {
+					t.Fatalf("refresh #%d: allow(%d) = %v, want %v", n, r.count, got, r.allow)
+				}
+				if r.allow {
+					g.written(r.count)
+				}
+				if g.allowEvent() != r.allow {
+					t.Errorf("refresh #%d: allowEvent() = %v, want %v", n, !r.allow, r.allow)
+				}
+			}
+		})
+	}
+}
+
+func TestShrinkGuardEvents(t *testing.T) {
+	g := &shrinkGuard{output: "targets.json", maxDrop: 5, overrideAfter: 2, previous: 100}
+	if g.allow(50) {
+		t.Fatal("allow(50) accepted a drop of 50 targets")
+	}
+	// the events received between two refreshes don't count as refreshes
+	for i := 0; i < 3; i++ {
+		if g.allowEvent() {
+			t.Fatal("allowEvent() accepted an event while the refreshes are refused")
+		}
+	}
+	if !g.allow(50) {
+		t.Fatal("allow(50) refused the second identical refresh")
+	}
+	g.written(50)
+
+	// events keep the reference of the next refresh up to date
+	if !g.allowEvent() {
+		t.Fatal("allowEvent() refused an event")
+	}
+	g.written(49)
+	if !g.allow(45) {
+		t.Error("allow(45) refused a drop of 4 targets since the last event")
+	}
+}
+
+func TestCountFileTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcppromd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "targets.json")
+	if got := countFileTargets(path); got != -1 {
+		t.Errorf("countFileTargets() = %d on a missing file, want -1", got)
+	}
+	if err := ioutil.WriteFile(path, []byte(`[{"targets":["a:1","b:1"],"labels":{}},{"targets":["c:1"],"labels":{}}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := countFileTargets(path); got != 3 {
+		t.Errorf("countFileTargets() = %d, want 3", got)
+	}
+	if err := ioutil.WriteFile(path, []byte(`not json`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := countFileTargets(path); got != -1 {
+		t.Errorf("countFileTargets() = %d on an invalid file, want -1", got)
+	}
+}
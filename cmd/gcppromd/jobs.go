@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/messagebird/gcppromd"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// jobState is the state of a daemon job kept across configuration reloads, it is identified by the job output.
+type jobState struct {
+	cache *targetsCache
+	guard *shrinkGuard
+	live  *liveTargets
+}
+
+func newJobState(cfg DaemonConfig) *jobState {
+	return &jobState{
+		cache: newTargetsCache(cfg.Output, cfg.StaleTargetsMaxAge),
+		guard: newShrinkGuard(cfg),
+		live:  newLiveTargets(),
+	}
+}
+
+// configure applies the settings of a reloaded configuration.
+func (s *jobState) configure(cfg DaemonConfig) {
+	s.cache.maxAge = cfg.StaleTargetsMaxAge
+	s.guard.maxDropPercent = cfg.MaxTargetsDropPercent
+	s.guard.maxDrop = cfg.MaxTargetsDrop
+	s.guard.overrideAfter = cfg.TargetsDropOverrideAfter
+}
+
+// jobsRunner runs the daemon jobs, they are restarted with their new configuration on reloads while the discovery
+// workers pool keeps running.
+type jobsRunner struct {
+	gceds  chan *gcppromd.GCEReqInstanceDiscovery
+	gcpds  *gcppromd.GCPProjectDiscovery
+	states map[string]*jobState
+
+	// states of the running jobs by name, read by the HTTP handlers
+	mu     sync.Mutex
+	byName map[string]*jobState
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newJobsRunner(gceds chan *gcppromd.GCEReqInstanceDiscovery, gcpds *gcppromd.GCPProjectDiscovery) *jobsRunner {
+	return &jobsRunner{
+		gceds:  gceds,
+		gcpds:  gcpds,
+		states: make(map[string]*jobState),
+		byName: make(map[string]*jobState),
+	}
+}
+
+// check verifies that the jobs can run.
+func (r *jobsRunner) check(cfgs []DaemonConfig) error {
+	subscriptions := make(map[string]string, len(cfgs))
+	for _, cfg := range cfgs {
+		if cfg.ProjectsAutoDiscovery && r.gcpds == nil {
+			return fmt.Errorf("GCP discovery required by the job %q is unavailable", cfg.Name)
+		}
+		if cfg.FeedSubscription == "" {
+			continue
+		}
+		// the messages of a subscription are delivered to one of its subscribers only
+		if other, has := subscriptions[cfg.FeedSubscription]; has {
+			return fmt.Errorf("jobs %q and %q share the feed subscription %s", other, cfg.Name, cfg.FeedSubscription)
+		}
+		subscriptions[cfg.FeedSubscription] = cfg.Name
+	}
+	return nil
+}
+
+// start runs the jobs until ctx is done or the jobs are stopped.
+func (r *jobsRunner) start(ctx context.Context, cfgs []DaemonConfig) {
+	ctx, r.cancel = context.WithCancel(ctx)
+
+	states := make(map[string]*jobState, len(cfgs))
+	byName := make(map[string]*jobState, len(cfgs))
+	for _, cfg := range cfgs {
+		logDaemonConfig(cfg)
+		state, has := r.states[cfg.Output]
+		if has {
+			state.configure(cfg)
+		} else {
+			state = newJobState(cfg)
+		}
+		states[cfg.Output] = state
+		byName[cfg.Name] = state
+
+		r.wg.Add(1)
+		go func(cfg DaemonConfig) {
+			defer r.wg.Done()
+			runDaemon(ctx, r.gceds, r.gcpds, cfg, state)
+		}(cfg)
+	}
+	r.states = states
+	r.mu.Lock()
+	r.byName = byName
+	r.mu.Unlock()
+}
+
+// targetsHandler serves the targets last written by a job, GET /v1/jobs/<name>/targets, including the changes applied
+// from its feed since its last collection.
+func (r *jobsRunner) targetsHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET", "HEAD": // allowed methods
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(req.URL.Path, "/v1/jobs/")
+	if !strings.HasSuffix(name, "/targets") {
+		http.NotFound(w, req)
+		return
+	}
+	name = strings.TrimSuffix(name, "/targets")
+
+	r.mu.Lock()
+	state, has := r.byName[name]
+	r.mu.Unlock()
+	if !has {
+		http.Error(w, fmt.Sprintf("unknown job %q", name), http.StatusNotFound)
+		return
+	}
+
+	configs, written := state.live.published()
+	if !written {
+		http.Error(w, "the targets of the job are not written yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(configs); err != nil {
+		log.WithError(err).Error("unexpected error while witting response")
+	}
+}
+
+// stop stops the jobs and waits for them to return.
+func (r *jobsRunner) stop() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.wg.Wait()
+}
+
+// reload replaces the running jobs by the jobs of cfgs.
+func (r *jobsRunner) reload(ctx context.Context, cfgs []DaemonConfig) error {
+	if err := r.check(cfgs); err != nil {
+		return err
+	}
+	r.stop()
+	log.Printf("Reloaded the configuration, running %d job(s)", len(cfgs))
+	r.start(ctx, cfgs)
+	return nil
+}
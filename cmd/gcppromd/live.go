@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/messagebird/gcppromd"
+)
+
+// liveTargets is the in-memory targets set of a job, it is replaced by every full collection of the targets and
+// updated in between by the instance changes published by the Cloud Asset Inventory feed of the job.
+type liveTargets struct {
+	mu sync.Mutex
+	// reconciled is false until the first full collection
+	reconciled bool
+	// targets by instance key and the targets that don't belong to an instance
+	instances map[string][]*gcppromd.PromConfig
+	others    []*gcppromd.PromConfig
+	// last event of every instance, kept to replay the changes a running collection may have missed
+	events map[string]*gcppromd.InstanceEvent
+	// since is the start of the last full collection, the older events are already reflected by its targets
+	since time.Time
+	// written are the targets last written to the output file, nil until the first write
+	written []*gcppromd.PromConfig
+}
+
+func newLiveTargets() *liveTargets {
+	return &liveTargets{
+		instances: make(map[string][]*gcppromd.PromConfig),
+		events:    make(map[string]*gcppromd.InstanceEvent),
+	}
+}
+
+// reconcile replaces the targets by the ones of a full collection started at started. The events of the changes
+// that happened after started are applied again since the collection may not have seen them.
+func (l *liveTargets) reconcile(configs []*gcppromd.PromConfig, started time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.reconciled = true
+	if started.After(l.since) {
+		l.since = started
+	}
+	l.instances = make(map[string][]*gcppromd.PromConfig, len(configs))
+	l.others = l.others[:0]
+	for _, config := range configs {
+		key, ok := gcppromd.InstanceKey(config)
+		if !ok {
+			l.others = append(l.others, config)
+			continue
+		}
+		l.instances[key] = append(l.instances[key], config)
+	}
+
+	for key, event := range l.events {
+		if event.Time.Before(started) {
+			delete(l.events, key)
+			continue
+		}
+		l.set(event)
+	}
+}
+
+// apply applies the change of an instance, it returns false when the event is older than the last one applied to
+// the instance or than the last full collection, the messages of a feed aren't ordered and can be redelivered.
+func (l *liveTargets) apply(event *gcppromd.InstanceEvent) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if event.Time.Before(l.since) {
+		return false
+	}
+	key := event.Key()
+	if last, ok := l.events[key]; ok && event.Time.Before(last.Time) {
+		return false
+	}
+	l.events[key] = event
+	l.set(event)
+	return true
+}
+
+func (l *liveTargets) set(event *gcppromd.InstanceEvent) {
+	if event.Deleted {
+		delete(l.instances, event.Key())
+	} else {
+		// the managed instance groups labels are carried over from the collection
+		l.instances[event.Key()] = event.WithMIGLabels(l.instances[event.Key()])
+	}
+}
+
+// configs returns the current targets, false until the first full collection.
+func (l *liveTargets) configs() ([]*gcppromd.PromConfig, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	keys := make([]string, 0, len(l.instances))
+	for key := range l.instances {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	configs := make([]*gcppromd.PromConfig, 0, len(keys)+len(l.others))
+	for _, key := range keys {
+		configs = append(configs, l.instances[key]...)
+	}
+	configs = append(configs, l.others...)
+	return configs, l.reconciled
+}
+
+// publish records the targets written to the output file, the ones served by the API. The targets refused by the
+// shrink guard are never published.
+func (l *liveTargets) publish(configs []*gcppromd.PromConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.written = configs
+}
+
+// published returns the targets last written to the output file, false until the first write.
+func (l *liveTargets) published() ([]*gcppromd.PromConfig, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.written, l.written != nil
+}
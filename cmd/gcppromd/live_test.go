@@ -0,0 +1,143 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/messagebird/gcppromd"
+	pmodel "github.com/prometheus/common/model"
+)
+
+// instanceConfig returns the target of the instance project-a/europe-west4-a/<name>.
+func instanceConfig(name, target string) *gcppromd.PromConfig {
+	return &gcppromd.PromConfig{
+		Targets: []string{target},
+		Labels: pmodel.LabelSet{
+			"__meta_gce_project":       "project-a",
+			"__meta_gce_zone":          "https://www.googleapis.com/compute/v1/projects/project-a/zones/europe-west4-a",
+			"__meta_gce_instance_name": pmodel.LabelValue(name),
+		},
+	}
+}
+
+func instanceEvent(name, target string, at time.Time) *gcppromd.InstanceEvent {
+	event := &gcppromd.InstanceEvent{Project: "project-a", Zone: "europe-west4-a", Name: name, Time: at, Deleted: target == ""}
+	if target != "" {
+		event.Configs = []*gcppromd.PromConfig{instanceConfig(name, target)}
+	}
+	return event
+}
+
+func liveTargetsList(t *testing.T, l *liveTargets) []string {
+	t.Helper()
+	configs, _ := l.configs()
+	targets := make([]string, 0, len(configs))
+	for _, config := range configs {
+		targets = append(targets, config.Targets...)
+	}
+	return targets
+}
+
+func TestLiveTargets(t *testing.T) {
+	t0 := time.Date(2021, 3, 4, 5, 0, 0, 0, time.UTC)
+	l := newLiveTargets()
+
+	if _, reconciled := l.configs(); reconciled {
+		t.Fatal("configs() reconciled before the first collection")
+	}
+	if !l.apply(instanceEvent("vm-1", "10.0.0.1:9100", t0)) {
+		t.Fatal("apply() refused the first event")
+	}
+
+	delegated := &gcppromd.PromConfig{Targets: []string{"lb:9100"}}
+	l.reconcile([]*gcppromd.PromConfig{instanceConfig("vm-1", "10.0.0.1:9100"), instanceConfig("vm-2", "10.0.0.2:9100"), delegated}, t0.Add(time.Minute))
+	if _, reconciled := l.configs(); !reconciled {
+		t.Fatal("configs() not reconciled after a collection")
+	}
+	if got, want := liveTargetsList(t, l), []string{"10.0.0.1:9100", "10.0.0.2:9100", "lb:9100"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("targets after reconcile = %v, want %v", got, want)
+	}
+
+	// an update then an older, out-of-order, delete of the same instance
+	if !l.apply(instanceEvent("vm-2", "10.0.0.20:9100", t0.Add(3*time.Minute))) {
+		t.Fatal("apply() refused an update")
+	}
+	if l.apply(instanceEvent("vm-2", "", t0.Add(2*time.Minute))) {
+		t.Fatal("apply() accepted an event older than the last one of the instance")
+	}
+	// a redelivered delete from before the collection
+	if l.apply(instanceEvent("vm-1", "", t0.Add(30*time.Second))) {
+		t.Fatal("apply() accepted an event older than the collection")
+	}
+	if got, want := liveTargetsList(t, l), []string{"10.0.0.1:9100", "10.0.0.20:9100", "lb:9100"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("targets after events = %v, want %v", got, want)
+	}
+
+	// the next collection started before the update of vm-2 and didn't see it, nor the deletion of vm-1
+	if !l.apply(instanceEvent("vm-1", "", t0.Add(5*time.Minute))) {
+		t.Fatal("apply() refused a delete")
+	}
+	l.reconcile([]*gcppromd.PromConfig{instanceConfig("vm-1", "10.0.0.1:9100"), instanceConfig("vm-2", "10.0.0.2:9100")}, t0.Add(2*time.Minute))
+	if got, want := liveTargetsList(t, l), []string{"10.0.0.20:9100"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("targets after the second reconcile = %v, want %v", got, want)
+	}
+
+	// the following collection saw all the changes, the events are forgotten
+	l.reconcile([]*gcppromd.PromConfig{instanceConfig("vm-2", "10.0.0.20:9100"), instanceConfig("vm-3", "10.0.0.3:9100")}, t0.Add(10*time.Minute))
+	if got, want := liveTargetsList(t, l), []string{"10.0.0.20:9100", "10.0.0.3:9100"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("targets after the third reconcile = %v, want %v", got, want)
+	}
+	if len(l.events) != 0 {
+		t.Errorf("events kept after a newer collection: %v", l.events)
+	}
+	if l.apply(instanceEvent("vm-3", "", t0.Add(9*time.Minute))) {
+		t.Error("apply() accepted an event older than the last collection")
+	}
+}
+
+func TestLiveTargetsPublished(t *testing.T) {
+	t0 := time.Date(2021, 3, 4, 5, 0, 0, 0, time.UTC)
+	l := newLiveTargets()
+
+	l.reconcile([]*gcppromd.PromConfig{instanceConfig("vm-1", "10.0.0.1:9100"), instanceConfig("vm-2", "10.0.0.2:9100")}, t0)
+	if _, written := l.published(); written {
+		t.Fatal("published() before the first write")
+	}
+	configs, _ := l.configs()
+	l.publish(configs)
+
+	// a collection refused by the shrink guard isn't published
+	l.reconcile([]*gcppromd.PromConfig{instanceConfig("vm-1", "10.0.0.1:9100")}, t0.Add(time.Minute))
+	published, written := l.published()
+	if !written {
+		t.Fatal("published() not written after a write")
+	}
+	if got, want := targetsOf(published), []string{"10.0.0.1:9100", "10.0.0.2:9100"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("published() = %v, want %v", got, want)
+	}
+}
+
+func TestLiveTargetsMIGLabels(t *testing.T) {
+	t0 := time.Date(2021, 3, 4, 5, 0, 0, 0, time.UTC)
+	l := newLiveTargets()
+
+	collected := instanceConfig("vm-1", "10.0.0.1:9100")
+	collected.Labels["__meta_gce_instance_group"] = "mig-a"
+	collected.Labels["__meta_gce_autoscaler"] = "autoscaler-a"
+	l.reconcile([]*gcppromd.PromConfig{collected}, t0)
+
+	// the targets of the events don't have the autoscaler labels
+	event := instanceEvent("vm-1", "10.0.0.10:9100", t0.Add(time.Minute))
+	event.Configs[0].Labels["__meta_gce_instance_group"] = "mig-a"
+	if !l.apply(event) {
+		t.Fatal("apply() refused an update")
+	}
+	configs, _ := l.configs()
+	if len(configs) != 1 {
+		t.Fatalf("configs() = %v, want the target of vm-1", configs)
+	}
+	if got := configs[0].Labels["__meta_gce_autoscaler"]; got != "autoscaler-a" {
+		t.Errorf("autoscaler label = %q after an update, want autoscaler-a", got)
+	}
+}
@@ -2,13 +2,19 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/messagebird/gcppromd"
 
@@ -17,21 +23,52 @@ import (
 	"io/ioutil"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
 	projectSeparator = ","
+
+	// errors modes of the instances handler
+	errorsLenient = "lenient"
+	errorsStrict  = "strict"
+
+	// headers set in lenient mode when the discovery of some projects failed: the number of failed discoveries, one per
+	// project and source, and the failed projects
+	headerDiscoveryErrors = "X-Gcppromd-Discovery-Errors"
+	headerFailedProjects  = "X-Gcppromd-Failed-Projects"
 )
 
 var (
-	flisten           = flag.String("listen", ":8080", "HTTP listen address")
+	flisten           = flag.String("listen", ":8080", "HTTP listen address, in daemon mode only /status, /metrics and /v1/jobs/<name>/targets are served and a daemon keeps running when it can't listen")
 	fdaemon           = flag.Bool("daemon", false, "run the application as a daemon that periodically produces a target file with a json in Prometheus file_sd format. Disables web-mode")
 	fouput            = flag.String("outputPath", "/etc/prom_sd/targets.json", "(daemon only)  A path to the output file with targets")
 	fdiscovery        = flag.Int64("frequency", 300, "(daemon only)  discovery frequency in seconds")
 	fprojects         = flag.String("projects", "", "(daemon only)  comma-separated projects IDs.")
 	fprojectsauto     = flag.Bool("projects-auto-discovery", false, "(daemon only)  enable auto-discovery of the projects based on which projects can be listed by the provided credentials.")
+	fprojectsincludes = flag.String("projects-includes", "", "(daemon only) RE2 regex, only the projects matching it will be discovered")
 	fprojectsexcludes = flag.String("projects-excludes", "", "(daemon only) RE2 regex, all projects matching it will not be discovered")
+	fprojectsparents  = flag.String("projects-parents", "", "(daemon only) comma-separated organizations/<id> and folders/<id> the auto-discovered projects are searched in, recursively, instead of all the projects the credentials can list")
+	fprojectslabels   = flag.String("projects-labels", "", "(daemon only) comma-separated label selectors the auto-discovered projects must all match: <key>=<value>, <key>!=<value>, <key> or !<key>, e.g. 'env=prod,!sandbox'")
+	fprojectsstates   = flag.String("projects-states", gcppromd.ProjectStateActive, "(daemon only) comma-separated lifecycle states of the auto-discovered projects: ACTIVE, DELETE_REQUESTED or DELETE_IN_PROGRESS, any when empty")
+	fpresencelabel    = flag.String("presence-label", gcppromd.DefaultPresenceLabel, "(daemon only) GCE label an instance must carry to be discovered")
+	fpresencevalue    = flag.String("presence-value", "", "(daemon only) RE2 regex the value of the presence label must match, any value when empty")
+	fpresencefilter   = flag.Bool("presence-filter", true, "(daemon only) only discover the instances carrying the presence label, when false the prometheus_ports* metadata alone select the targets")
+	faddressfamily    = flag.String("address-family", gcppromd.AddressFamilyIPv4, "(daemon only) address family of the targets, ipv4 or ipv6, unless overridden by the prometheus_address_family* metadata of the instances")
+	faddressmode      = flag.String("address-mode", gcppromd.AddressModePrivate, "(daemon only) address of the targets: private, public, zonal-dns or global-dns, unless overridden by the prometheus_address_mode* metadata of the instances")
+	ffilter           = flag.String("filter", "", "(daemon only) GCE API filter expression the discovered instances must match, e.g. 'labels.env eq prod'")
+	fsources          = flag.String("sources", gcppromd.SourceGCE, "(daemon only) comma-separated discovery sources: gce (instances carrying the presence label), gke (nodes of the GKE clusters), cloudsql (Cloud SQL instances), memorystore (Memorystore for Redis instances), forwarding-rules (load balancers carrying the presence label), cloudrun (Cloud Run services carrying the presence label), neg (endpoints of the network endpoint groups annotated with the presence label) and asset-inventory (instances of the -asset-scopes carrying the presence label)")
+	fgkeports         = flag.String("gke-ports", "kubelet:10250,node-exporter:9100", "(daemon only) comma-separated <name>:<port> ports scraped on every GKE node")
+	fcloudsqlexporter = flag.String("cloudsql-exporter", "", "(daemon only) address of the exporter scraping the Cloud SQL instances, a text/template e.g. 'sql-exporter:9187' or '{{.Name}}-exporter:9187', required by the cloudsql source")
+	fassetscopes      = flag.String("asset-scopes", "", "(daemon only) comma-separated organizations/<id> and folders/<id> whose instances are discovered at once with the Cloud Asset Inventory by the asset-inventory source")
+	ffeedsubscription = flag.String("feed-subscription", "", "(daemon only) Pub/Sub subscription, projects/<project>/subscriptions/<name>, of a Cloud Asset Inventory feed of the instances applied to the targets as soon as they change")
+	fredisexporter    = flag.String("memorystore-exporter", "", "(daemon only) address of the exporter scraping the Memorystore instances, a text/template e.g. 'redis-exporter:9121', required by the memorystore source")
+	fstaletargets     = flag.Int64("stale-targets-max-age", 3600, "(daemon only) maximum age in seconds of the last known targets of a project, used while its discovery fails. 0 disables it")
+	fmaxdroppercent   = flag.Float64("max-targets-drop-percent", 0, "(daemon only) the output file is not replaced when the number of targets decreases by more than this percentage since the previous write. 0 disables it")
+	fmaxdrop          = flag.Int("max-targets-drop", 0, "(daemon only) the output file is not replaced when the number of targets decreases by more than this number since the previous write. 0 disables it")
+	fdropoverride     = flag.Int("targets-drop-override-after", 3, "(daemon only) number of consecutive refreshes discovering the same decreased number of targets after which it is written anyway. 0 never writes it")
+	fconfig           = flag.String("config", "", "(daemon only) path to a YAML or JSON configuration file declaring the discovery jobs, replaces the per job flags")
 	fworkers          = flag.Int("workers", 20, "number of workers to perform the discovery")
 )
 
@@ -45,24 +82,43 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	ctxPool, cancelPool := context.WithCancel(context.Background())
 
+	// reloads of the configuration requested with SIGHUP
+	reloads := make(chan struct{}, 1)
+
 	go func() {
 		defer close(idleConnsClosed)
 		defer cancelPool()
 		defer cancel()
 
-		sigint := make(chan os.Signal, 1)
-		signal.Notify(sigint, os.Interrupt)
-		<-sigint
-		log.Info("Received interrupt, shutting down")
-
-		if !*fdaemon {
-			ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-			defer cancel()
-			if err := httpSrv.Shutdown(ctx); err != nil {
-				// Error from closing listeners, or context timeout:
-				log.Printf("HTTP server Shutdown: %v", err)
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+		for sig := range sigs {
+			if sig != syscall.SIGHUP {
+				log.Infof("Received %v, shutting down", sig)
+				break
+			}
+			if !*fdaemon {
+				log.Info("Received SIGHUP, nothing to reload in web-server mode")
+				continue
+			}
+			if *fconfig == "" {
+				// the flags can't change, reloading them would only restart the discovery
+				log.Info("Received SIGHUP, nothing to reload without -config")
+				continue
+			}
+			log.Info("Received SIGHUP, reloading the configuration")
+			select {
+			case reloads <- struct{}{}:
+			default: // a reload is already pending
 			}
 		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+		defer cancel()
+		if err := httpSrv.Shutdown(ctx); err != nil {
+			// Error from closing listeners, or context timeout:
+			log.Printf("HTTP server Shutdown: %v", err)
+		}
 	}()
 
 	gceds, err := gcppromd.NewGCEDiscoveryPool(ctxPool, *fworkers)
@@ -71,37 +127,49 @@ func main() {
 	}
 
 	gcpds, err := gcppromd.NewGCPProjectDiscovery()
-	if *fprojectsauto && err != nil {
-		log.WithError(err).Fatal("Cannot initialise GCP discovery")
+	if err != nil {
+		if *fprojectsauto {
+			log.WithError(err).Fatal("Cannot initialise GCP discovery")
+		}
+		log.WithError(err).Warn("Cannot initialise GCP discovery, projects auto-discovery is unavailable")
 	}
 
+	h := handle{gceds, gcpds}
+	http.HandleFunc("/status", h.statusHandler)
+	http.Handle("/metrics", promhttp.Handler())
+
 	if *fdaemon {
-		var pexcludes *regexp.Regexp
-		if *fprojectsexcludes != "" {
-			pexcludes, err = regexp.Compile(*fprojectsexcludes)
-			if err != nil {
-				log.WithError(err).Fatal("Invalid project exclude pattern")
-			}
+		runner := newJobsRunner(gceds, gcpds)
+		http.HandleFunc("/v1/jobs/", runner.targetsHandler)
+		go listenAndServe(&httpSrv, true)
+
+		cfgs, err := loadDaemonConfigs()
+		if err != nil {
+			log.WithError(err).Fatal("Invalid daemon configuration")
 		}
 
-		log.Printf("Running as a daemon, output is going to be written to %s", *fouput)
-		log.Printf("Targets update frequency: %v seconds", *fdiscovery)
-		log.Printf("Projects Auto-Discovery: %t", *fprojectsauto)
-		projects := parseProjectsSet(*fprojects)
-		if len(projects) == 0 && !*fprojectsauto {
-			log.Warnf("Empty '-projects=%s' flag in daemon mode", *fprojects)
-		}
-		log.Printf("Targets projects: %v", projectsSetList(projects))
-		if pexcludes != nil {
-			log.Printf("Projects exclude pattern: %s", pexcludes.String())
-		}
-		runDaemon(ctx, gceds, gcpds, DaemonConfig{
-			Output:                 *fouput,
-			Frequency:              time.Second * time.Duration(*fdiscovery),
-			Projects:               projects,
-			ProjectsExcludePattern: pexcludes,
-			ProjectsAutoDiscovery:  *fprojectsauto,
-		})
+		if err := runner.check(cfgs); err != nil {
+			log.WithError(err).Fatal("Invalid daemon configuration")
+		}
+		log.Printf("Running as a daemon with %d job(s)", len(cfgs))
+		runner.start(ctx, cfgs)
+
+	daemon:
+		for {
+			select {
+			case <-ctx.Done():
+				break daemon
+			case <-reloads:
+				cfgs, err := loadDaemonConfigs()
+				if err == nil {
+					err = runner.reload(ctx, cfgs)
+				}
+				if err != nil {
+					log.WithError(err).Error("Invalid daemon configuration, keeping the current one")
+				}
+			}
+		}
+		runner.stop()
 	} else {
 		log.Printf("Running as a web-server")
 		if *fprojects != "" {
@@ -110,25 +178,72 @@ func main() {
 		if *fprojectsauto == true {
 			log.Warnf("Ignored '-projects-auto-discovery=true' flag in web-server mode")
 		}
+		if *fprojectsincludes != "" {
+			log.Warnf("Ignored '-projects-includes=%s' flag in web-server mode", *fprojectsincludes)
+		}
 		if *fprojectsexcludes != "" {
 			log.Warnf("Ignored '-projects-excludes=%s' flag in web-server mode", *fprojectsexcludes)
 		}
-		runWebServer(ctx, gceds, gcpds, &httpSrv)
+		if *fprojectsparents != "" {
+			log.Warnf("Ignored '-projects-parents=%s' flag in web-server mode", *fprojectsparents)
+		}
+		if *fprojectslabels != "" {
+			log.Warnf("Ignored '-projects-labels=%s' flag in web-server mode", *fprojectslabels)
+		}
+		if *fprojectsstates != gcppromd.ProjectStateActive {
+			log.Warnf("Ignored '-projects-states=%s' flag in web-server mode", *fprojectsstates)
+		}
+		if *fconfig != "" {
+			log.Warnf("Ignored '-config=%s' flag in web-server mode", *fconfig)
+		}
+		if *ffilter != "" {
+			log.Warnf("Ignored '-filter=%s' flag in web-server mode", *ffilter)
+		}
+		if *fpresencelabel != gcppromd.DefaultPresenceLabel || *fpresencevalue != "" || !*fpresencefilter {
+			log.Warnf("Ignored '-presence-*' flags in web-server mode")
+		}
+		if *faddressfamily != gcppromd.AddressFamilyIPv4 {
+			log.Warnf("Ignored '-address-family=%s' flag in web-server mode", *faddressfamily)
+		}
+		if *faddressmode != gcppromd.AddressModePrivate {
+			log.Warnf("Ignored '-address-mode=%s' flag in web-server mode", *faddressmode)
+		}
+		if *ffeedsubscription != "" {
+			log.Warnf("Ignored '-feed-subscription=%s' flag in web-server mode", *ffeedsubscription)
+		}
+		if *fassetscopes != "" {
+			log.Warnf("Ignored '-asset-scopes=%s' flag in web-server mode", *fassetscopes)
+		}
+		if *fsources != gcppromd.SourceGCE {
+			log.Warnf("Ignored '-sources=%s' flag in web-server mode", *fsources)
+		}
+		if *fgkeports != "kubelet:10250,node-exporter:9100" {
+			log.Warnf("Ignored '-gke-ports=%s' flag in web-server mode", *fgkeports)
+		}
+		if *fcloudsqlexporter != "" {
+			log.Warnf("Ignored '-cloudsql-exporter=%s' flag in web-server mode", *fcloudsqlexporter)
+		}
+		if *fredisexporter != "" {
+			log.Warnf("Ignored '-memorystore-exporter=%s' flag in web-server mode", *fredisexporter)
+		}
+		runWebServer(&h, &httpSrv)
 	}
 	<-idleConnsClosed
 }
 
-type ProjectsSet map[string]interface{}
+// ProjectsSet are projects by ID, along with their metadata when they were auto-discovered, nil when they were
+// listed explicitly.
+type ProjectsSet map[string]*gcppromd.Project
 
 // parseProjects parse and de-duplicate a raw projects string project-1,project-b
 func parseProjectsSet(raw string) (projects ProjectsSet) {
-	projects = map[string]interface{}{}
+	projects = ProjectsSet{}
 	for _, project := range strings.Split(raw, projectSeparator) {
 		if project == "" {
 			continue
 		}
 		if _, has := projects[project]; !has {
-			projects[project] = 1
+			projects[project] = nil
 		}
 	}
 	return
@@ -140,12 +255,30 @@ func projectsSetAdd(projects ProjectsSet, toAdd []string) ProjectsSet {
 			continue
 		}
 		if _, has := projects[p]; !has {
-			projects[p] = 1
+			projects[p] = nil
 		}
 	}
 	return projects
 }
 
+// projectsSetAddDiscovered returns the projects listed explicitly and the auto-discovered ones, the projects listed
+// explicitly are kept as they are. The projects set isn't modified.
+func projectsSetAddDiscovered(projects ProjectsSet, discovered []*gcppromd.Project) ProjectsSet {
+	out := make(ProjectsSet, len(projects)+len(discovered))
+	for id, project := range projects {
+		out[id] = project
+	}
+	for _, p := range discovered {
+		if p.ID == "" {
+			continue
+		}
+		if _, has := projects[p.ID]; !has {
+			out[p.ID] = p
+		}
+	}
+	return out
+}
+
 func projectsSetList(set ProjectsSet) (out []string) {
 	out = make([]string, 0, len(set))
 	for p := range set {
@@ -154,66 +287,331 @@ func projectsSetList(set ProjectsSet) (out []string) {
 	return
 }
 
-// projectSetExclude excludes all projects matching the given pattern
-func projectsSetExclude(projects ProjectsSet, pattern *regexp.Regexp) ProjectsSet {
-	if pattern == nil {
-		return projects
+// projectsFilter selects the projects to discover. The labels and states only apply to the auto-discovered projects.
+type projectsFilter struct {
+	Include *regexp.Regexp
+	Exclude *regexp.Regexp
+	Labels  gcppromd.LabelSelectors
+	// States are the lifecycle states of the projects, any when empty
+	States []string
+}
+
+func (f projectsFilter) matches(id string, project *gcppromd.Project) bool {
+	if f.Include != nil && !f.Include.MatchString(id) {
+		return false
+	}
+	if f.Exclude != nil && f.Exclude.MatchString(id) {
+		return false
+	}
+	if project == nil {
+		return true
+	}
+	if !f.Labels.Matches(project.Labels) {
+		return false
+	}
+	if len(f.States) == 0 {
+		return true
+	}
+	for _, state := range f.States {
+		if project.State == state {
+			return true
+		}
 	}
-	out := make(map[string]interface{}, len(projects))
-	for project := range projects {
-		if !pattern.MatchString(project) {
-			out[project] = 1
+	return false
+}
+
+// projectsSetFilter returns the projects selected by the filter
+func projectsSetFilter(projects ProjectsSet, filter projectsFilter) ProjectsSet {
+	out := make(ProjectsSet, len(projects))
+	for id, project := range projects {
+		if filter.matches(id, project) {
+			out[id] = project
 		}
 	}
 	return out
 }
 
-func collectTargets(ctx context.Context, gceds chan *gcppromd.GCEReqInstanceDiscovery, projects []string) ([]*gcppromd.PromConfig, bool) {
-	if len(projects) == 0 {
-		return []*gcppromd.PromConfig{}, true
+// parseSources parses and de-duplicates a raw sources string gce,gke, SourceGCE when empty.
+func parseSources(raw string) []string {
+	sources := make([]string, 0, len(gcppromd.Sources))
+	seen := make(map[string]bool, len(gcppromd.Sources))
+	for _, source := range strings.Split(raw, projectSeparator) {
+		source = strings.TrimSpace(source)
+		if source == "" || seen[source] {
+			continue
+		}
+		seen[source] = true
+		sources = append(sources, source)
+	}
+	if len(sources) == 0 {
+		sources = append(sources, gcppromd.SourceGCE)
+	}
+	return sources
+}
+
+// validateProjectsAutoDiscovery checks that the parents and label selectors narrowing down the projects
+// auto-discovery are only given along with it.
+func validateProjectsAutoDiscovery(auto bool, parents []string, labels gcppromd.LabelSelectors) error {
+	if !auto && (len(parents) > 0 || len(labels) > 0) {
+		return errors.New("projects parents and labels require the projects auto-discovery")
+	}
+	for _, parent := range parents {
+		if err := gcppromd.ValidateProjectsParent(parent); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	cerrors := make(chan error)
-	defer close(cerrors)
-	cconfigs := make(chan []*gcppromd.PromConfig)
-	defer close(cconfigs)
+// validateAssetScopes checks the scopes of the asset-inventory source.
+func validateAssetScopes(sources, scopes []string, filter string) error {
+	asset := false
+	for _, source := range sources {
+		asset = asset || source == gcppromd.SourceAssetInventory
+	}
+	switch {
+	case asset && len(scopes) == 0:
+		return fmt.Errorf("the %s source requires asset scopes", gcppromd.SourceAssetInventory)
+	case !asset && len(scopes) > 0:
+		return fmt.Errorf("asset scopes are only used by the %s source", gcppromd.SourceAssetInventory)
+	case asset && filter != "":
+		return fmt.Errorf("the %s source doesn't support filters", gcppromd.SourceAssetInventory)
+	}
+	for _, scope := range scopes {
+		if err := gcppromd.ValidateAssetScope(scope); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	go func() {
-		for _, project := range projects {
-			gceds <- &gcppromd.GCEReqInstanceDiscovery{
+// validateFeedSubscription checks that the instances changes published by a feed can be applied to the targets of a
+// job.
+func validateFeedSubscription(subscription string, sources []string, filter string) error {
+	if subscription == "" {
+		return nil
+	}
+	if err := gcppromd.ValidateSubscription(subscription); err != nil {
+		return err
+	}
+	instances := false
+	for _, source := range sources {
+		instances = instances || source == gcppromd.SourceGCE || source == gcppromd.SourceAssetInventory
+	}
+	if !instances {
+		return fmt.Errorf("a feed subscription requires the %s or %s source", gcppromd.SourceGCE, gcppromd.SourceAssetInventory)
+	}
+	if filter != "" {
+		// the filter can't be evaluated on the instances published by the feed
+		return errors.New("a feed subscription doesn't support filters")
+	}
+	return nil
+}
+
+// discoveryUnit is a project, or the scope of the asset-inventory source, to discover from a source.
+type discoveryUnit struct {
+	Project string
+	Source  string
+}
+
+// discoveryUnits returns the discoveries of every project from every source, the asset-inventory source discovers
+// the asset scopes instead of the projects.
+func discoveryUnits(projects, sources, assetScopes []string) []discoveryUnit {
+	units := make([]discoveryUnit, 0, len(projects)*len(sources))
+	for _, source := range sources {
+		targets := projects
+		if source == gcppromd.SourceAssetInventory {
+			targets = assetScopes
+		}
+		for _, project := range targets {
+			units = append(units, discoveryUnit{Project: project, Source: source})
+		}
+	}
+	return units
+}
+
+// projectTargets is the outcome of the discovery of one project from one source.
+type projectTargets struct {
+	Project string
+	Source  string
+	Configs []*gcppromd.PromConfig
+	// Err is a *gcppromd.ProjectError when the discovery failed
+	Err error
+}
+
+// collectTargets discovers the targets of all the given units, it returns false if the collection could not
+// complete.
+func collectTargets(ctx context.Context, gceds chan *gcppromd.GCEReqInstanceDiscovery, units []discoveryUnit, filter string, opts gcppromd.DiscoveryOptions) ([]*projectTargets, bool) {
+	total := len(units)
+	results := make([]*projectTargets, 0, total)
+	if total == 0 {
+		return results, true
+	}
+
+	// buffered so that no go routine is left behind when the collection is interrupted.
+	cresults := make(chan *projectTargets, total)
+
+	discoveryQueueDepth.Add(float64(total))
+	for _, unit := range units {
+		go func(project, source string) {
+			req := &gcppromd.GCEReqInstanceDiscovery{
 				Project:           project,
-				Filter:            "",
-				PrometheusConfigs: cconfigs,
-				Errors:            cerrors,
+				Source:            source,
+				Filter:            filter,
+				Options:           opts,
+				PrometheusConfigs: make(chan []*gcppromd.PromConfig, 1),
+				Errors:            make(chan error, 1),
 			}
-		}
-	}()
+			select {
+			case <-ctx.Done():
+				discoveryQueueDepth.Dec()
+				cresults <- &projectTargets{Project: project, Source: source, Err: &gcppromd.ProjectError{Project: project, Source: source, Err: ctx.Err()}}
+				return
+			case gceds <- req:
+				discoveryQueueDepth.Dec()
+			}
+			select {
+			case err := <-req.Errors:
+				cresults <- &projectTargets{Project: project, Source: source, Err: err}
+			case configs := <-req.PrometheusConfigs:
+				cresults <- &projectTargets{Project: project, Source: source, Configs: configs}
+			}
+		}(unit.Project, unit.Source)
+	}
 
-	configs := make([]*gcppromd.PromConfig, 0, 100)
-	queries := len(projects)
-	for n := 0; n < queries; n++ {
+	for n := 0; n < total; n++ {
 		select {
 		case <-ctx.Done():
-			return configs, false
-		case err := <-cerrors:
-			log.WithFields(log.Fields{
-				"err": err,
-			}).Println("Errors will discovering GCE instances.")
-		case lconfigs := <-cconfigs:
-			configs = append(configs, lconfigs...)
+			return results, false
+		case result := <-cresults:
+			if result.Err != nil {
+				log.WithFields(log.Fields{
+					"err":     result.Err,
+					"project": result.Project,
+					"source":  result.Source,
+				}).Println("Errors will discovering targets.")
+			}
+			results = append(results, result)
 		}
 	}
 
-	return configs, true
+	return results, true
+}
+
+// mergeTargets returns the targets of all the projects discovered and the errors of the others.
+func mergeTargets(results []*projectTargets) ([]*gcppromd.PromConfig, []error) {
+	configs := make([]*gcppromd.PromConfig, 0, 100)
+	var errs []error
+	for _, result := range results {
+		if result.Err != nil {
+			errs = append(errs, result.Err)
+			continue
+		}
+		configs = append(configs, result.Configs...)
+	}
+	return configs, errs
 }
 
 // DaemonConfig configuration for the daemon
 type DaemonConfig struct {
+	// Name of the job in the logs
+	Name                   string
 	Output                 string
 	Frequency              time.Duration
 	Projects               ProjectsSet
+	ProjectsIncludePattern *regexp.Regexp
 	ProjectsExcludePattern *regexp.Regexp
 	ProjectsAutoDiscovery  bool
+	// ProjectsParents are the organizations and folders the projects are auto-discovered in, all the projects the
+	// credentials can list when empty
+	ProjectsParents []string
+	// ProjectsLabels select the auto-discovered projects by their labels
+	ProjectsLabels gcppromd.LabelSelectors
+	// ProjectsStates are the lifecycle states of the auto-discovered projects, any when empty
+	ProjectsStates []string
+	// Sources of the targets, see gcppromd.Sources
+	Sources []string
+	// AssetScopes are the organizations and folders discovered by the asset-inventory source
+	AssetScopes []string
+	// FeedSubscription is the Pub/Sub subscription of the Cloud Asset Inventory feed updating the targets between
+	// two collections, none when empty
+	FeedSubscription string
+	// Filter passed to the GCE API when looking up instances
+	Filter  string
+	Options gcppromd.DiscoveryOptions
+	// StaleTargetsMaxAge is how long the last known targets of a project are used when its discovery fails
+	StaleTargetsMaxAge time.Duration
+	// MaxTargetsDropPercent and MaxTargetsDrop are the relative and absolute decrease of the number of targets,
+	// compared to the previous write, above which the output file is not replaced. 0 disables them.
+	MaxTargetsDropPercent float64
+	MaxTargetsDrop        int
+	// TargetsDropOverrideAfter is the number of consecutive refreshes with the same number of targets after which
+	// a drop is accepted. 0 never accepts it.
+	TargetsDropOverrideAfter int
+}
+
+// projectsFilter returns the filter selecting the projects of the job.
+func (cfg DaemonConfig) projectsFilter() projectsFilter {
+	return projectsFilter{
+		Include: cfg.ProjectsIncludePattern,
+		Exclude: cfg.ProjectsExcludePattern,
+		Labels:  cfg.ProjectsLabels,
+		States:  cfg.ProjectsStates,
+	}
+}
+
+// assetScoped reports whether the job discovers the instances of organizations or folders.
+func (cfg DaemonConfig) assetScoped() bool {
+	for _, source := range cfg.Sources {
+		if source == gcppromd.SourceAssetInventory {
+			return true
+		}
+	}
+	return false
+}
+
+func logDaemonConfig(cfg DaemonConfig) {
+	logger := log.WithField("job", cfg.Name)
+	logger.Printf("Output is going to be written to %s", cfg.Output)
+	logger.Printf("Targets update frequency: %v", cfg.Frequency)
+	logger.Printf("Projects Auto-Discovery: %t", cfg.ProjectsAutoDiscovery)
+	if len(cfg.Projects) == 0 && !cfg.ProjectsAutoDiscovery && len(cfg.AssetScopes) == 0 {
+		logger.Warn("Empty projects list in daemon mode")
+	}
+	logger.Printf("Targets projects: %v", projectsSetList(cfg.Projects))
+	logger.Printf("Targets sources: %v", cfg.Sources)
+	if len(cfg.AssetScopes) > 0 {
+		logger.Printf("Asset scopes: %v", cfg.AssetScopes)
+	}
+	if cfg.FeedSubscription != "" {
+		logger.Printf("Asset feed subscription: %s", cfg.FeedSubscription)
+	}
+	if len(cfg.ProjectsParents) > 0 {
+		logger.Printf("Projects parents: %v", cfg.ProjectsParents)
+	}
+	if len(cfg.ProjectsLabels) > 0 {
+		logger.Printf("Projects labels: %s", cfg.ProjectsLabels)
+	}
+	if cfg.ProjectsAutoDiscovery {
+		logger.Printf("Projects states: %v", cfg.ProjectsStates)
+	}
+	if cfg.ProjectsIncludePattern != nil {
+		logger.Printf("Projects include pattern: %s", cfg.ProjectsIncludePattern.String())
+	}
+	if cfg.ProjectsExcludePattern != nil {
+		logger.Printf("Projects exclude pattern: %s", cfg.ProjectsExcludePattern.String())
+	}
+	if cfg.Filter != "" {
+		logger.Printf("Instances filter: %s", cfg.Filter)
+	}
+	if cfg.Options.DisablePresenceFilter {
+		logger.Printf("Presence filter disabled")
+	} else {
+		logger.Printf("Presence label: %s", cfg.Options.PresenceLabel)
+		if cfg.Options.PresenceValue != "" {
+			logger.Printf("Presence value pattern: %s", cfg.Options.PresenceValue)
+		}
+	}
 }
 
 func runDaemon(
@@ -221,72 +619,123 @@ func runDaemon(
 	gceds chan *gcppromd.GCEReqInstanceDiscovery,
 	gcpds *gcppromd.GCPProjectDiscovery,
 	cfg DaemonConfig,
+	state *jobState,
 ) {
+	logger := log.WithField("job", cfg.Name)
 	timer := time.NewTimer(1 * time.Nanosecond)
 	defer timer.Stop()
 
-	projectsSet := projectsSetExclude(cfg.Projects, cfg.ProjectsExcludePattern)
+	projectsSet := projectsSetFilter(cfg.Projects, cfg.projectsFilter())
+
+	events := make(chan *gcppromd.InstanceEvent, feedEventsBuffer)
+	if cfg.FeedSubscription != "" {
+		go watchFeed(ctx, logger, cfg, events)
+	}
 
-	// Extract the directory to create a temporary file in the same directory as the output file.
-	// It is needed because not all operating systems or file systems support moving a file atomically
-	// from different directories or volumes.
-	tmpbase := filepath.Dir(cfg.Output)
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case event := <-events:
+			if _, has := projectsSet[event.Project]; !has && !cfg.assetScoped() {
+				continue
+			}
+			if !state.live.apply(event) {
+				continue
+			}
+			configs, reconciled := state.live.configs()
+			if !reconciled {
+				// the other targets are unknown until the first collection
+				continue
+			}
+			// the targets of the last refresh were refused, they aren't written along with the event either
+			if !state.guard.allowEvent() {
+				continue
+			}
+			count := gcppromd.CountTargets(configs)
+			if err := writeTargets(cfg.Output, configs); err != nil {
+				logger.WithError(err).WithField("file", cfg.Output).Error("could not write output file")
+				continue
+			}
+			state.guard.written(count)
+			state.live.publish(configs)
+			daemonLastWrite.WithLabelValues(cfg.Output).SetToCurrentTime()
+
+			logger.WithFields(log.Fields{
+				"instance": event.Key(),
+				"deleted":  event.Deleted,
+			}).Info("target list updated by a feed event")
 		case <-timer.C:
 			timer.Reset(cfg.Frequency)
 
 			discoveryStarted := time.Now()
 			if cfg.ProjectsAutoDiscovery {
-				discovered, err := gcpds.Projects(ctx)
+				discovered, err := gcpds.Projects(ctx, cfg.ProjectsParents)
 				if err != nil {
-					log.WithError(err).Error("can't auto-discover projects")
+					logger.WithError(err).Error("can't auto-discover projects")
 				} else {
-					projectsSet = projectsSetExclude(projectsSetAdd(projectsSet, discovered), cfg.ProjectsExcludePattern)
+					// rebuilt from the projects listed explicitly, the projects deleted or moved since are dropped
+					projectsSet = projectsSetFilter(projectsSetAddDiscovered(cfg.Projects, discovered), cfg.projectsFilter())
 				}
 			}
 
-			configs, ok := collectTargets(ctx, gceds, projectsSetList(projectsSet))
+			units := discoveryUnits(projectsSetList(projectsSet), cfg.Sources, cfg.AssetScopes)
+			results, ok := collectTargets(ctx, gceds, units, cfg.Filter, cfg.Options)
 			if !ok {
-				log.Info("invalid targets collection, skipping")
+				logger.Info("invalid targets collection, skipping")
 				continue
 			}
-
-			// write to a temporary file then swap it to ensure that the output file doesn't get corrupted or an half backed version is read.
-			f, err := ioutil.TempFile(tmpbase, "")
-			if err != nil {
-				log.WithError(err).Error("can't open temporary file")
+			state.live.reconcile(state.cache.update(results, time.Now()), discoveryStarted)
+			configs, _ := state.live.configs()
+			count := gcppromd.CountTargets(configs)
+			if !state.guard.allow(count) {
 				continue
 			}
 
-			enc := json.NewEncoder(f)
-			if err := enc.Encode(configs); err != nil {
-				log.WithError(err).Error("can't encode prometheus targets configuration to json")
+			if err := writeTargets(cfg.Output, configs); err != nil {
+				logger.WithError(err).WithField("file", cfg.Output).Error("could not write output file")
 				continue
 			}
+			state.guard.written(count)
+			state.live.publish(configs)
+			daemonLastWrite.WithLabelValues(cfg.Output).SetToCurrentTime()
 
-			err = f.Sync()
+			logger.Infof("target list updated, took %v", time.Since(discoveryStarted))
+		}
+	}
+}
 
-			if closeErr := f.Close(); err == nil {
-				err = closeErr
-			}
-			if permErr := os.Chmod(f.Name(), 0644); err == nil {
-				err = permErr
-			}
-			if err == nil {
-				err = os.Rename(f.Name(), cfg.Output)
-			}
-			if err != nil {
-				log.WithError(err).WithField("file", cfg.Output).Error("could not write output file")
-				os.Remove(f.Name())
-				continue
-			}
+// writeTargets writes the targets to the output file.
+func writeTargets(output string, configs []*gcppromd.PromConfig) error {
+	// Extract the directory to create a temporary file in the same directory as the output file.
+	// It is needed because not all operating systems or file systems support moving a file atomically
+	// from different directories or volumes.
+	tmpbase := filepath.Dir(output)
 
-			log.Infof("target list updated, took %v", time.Since(discoveryStarted))
-		}
+	// write to a temporary file then swap it to ensure that the output file doesn't get corrupted or an half backed version is read.
+	f, err := ioutil.TempFile(tmpbase, "")
+	if err != nil {
+		return fmt.Errorf("can't open temporary file: %v", err)
+	}
+
+	enc := json.NewEncoder(f)
+	err = enc.Encode(configs)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
 	}
+	if permErr := os.Chmod(f.Name(), 0644); err == nil {
+		err = permErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), output)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
 }
 
 type handle struct {
@@ -309,15 +758,24 @@ func requestLogger(handler http.Handler) http.Handler {
 	return http.HandlerFunc(fn)
 }
 
-func runWebServer(ctx context.Context, gceds chan *gcppromd.GCEReqInstanceDiscovery, gcpds *gcppromd.GCPProjectDiscovery, srv *http.Server) {
-	h := handle{gceds, gcpds}
-
-	http.HandleFunc("/status", h.statusHandler)
+func runWebServer(h *handle, srv *http.Server) {
 	http.HandleFunc("/v1/gce/instances", h.instancesHandler)
+	http.HandleFunc("/v1/http_sd/gce", h.httpSDHandler)
+
+	listenAndServe(srv, false)
+}
 
+// listenAndServe serves srv until it is shut down. When the address can't be listened on, e.g. by several daemons
+// sharing a host network, a daemon keeps writing its output files while the web-server exits.
+func listenAndServe(srv *http.Server, daemon bool) {
 	log.Infof("Listening on %s...", srv.Addr)
 
-	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+	err := srv.ListenAndServe()
+	switch {
+	case err == http.ErrServerClosed:
+	case daemon:
+		log.WithError(err).Error("Failed to start HTTP daemon, /status, /metrics and /v1/jobs/ are unavailable.")
+	default:
 		log.WithError(err).Fatal("Failed to start HTTP daemon.")
 	}
 }
@@ -331,42 +789,153 @@ func (h *handle) statusHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h *handle) instancesHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET", "HEAD": // allowed methods
-	default:
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-		return
-	}
-
-	var err error
-
+// discover runs a discovery configured by the request query parameters. When the parameters are invalid or the
+// projects can't be resolved it returns an error along with the HTTP status code to reply with.
+func (h *handle) discover(r *http.Request) (configs []*gcppromd.PromConfig, errs []error, ok bool, status int, err error) {
 	// extracts a set of project names
 	projectsSet := parseProjectsSet(r.URL.Query().Get("projects"))
+	projectsInclude := r.URL.Query().Get("projects-includes")
 	projectsExclude := r.URL.Query().Get("projects-excludes")
 	projectsAutoDiscoveryValue := strings.ToLower(r.URL.Query().Get("projects-auto-discovery"))
 	projectsAutoDiscovery := projectsAutoDiscoveryValue == "true" || projectsAutoDiscoveryValue == "1"
+	projectsParents := projectsSetList(parseProjectsSet(r.URL.Query().Get("projects-parents")))
+	filter := r.URL.Query().Get("filter")
+
+	if err := gcppromd.ValidateFilter(filter); err != nil {
+		return nil, nil, false, http.StatusBadRequest, err
+	}
+	sources := parseSources(r.URL.Query().Get("sources"))
+	assetScopes := projectsSetList(parseProjectsSet(r.URL.Query().Get("asset-scopes")))
+	opts, err := parseDiscoveryOptions(r.URL.Query())
+	if err == nil {
+		err = opts.ValidateSources(sources)
+	}
+	if err == nil {
+		err = validateAssetScopes(sources, assetScopes, filter)
+	}
+	var projectsLabels gcppromd.LabelSelectors
+	if err == nil {
+		projectsLabels, err = gcppromd.ParseLabelSelectors(r.URL.Query().Get("projects-labels"))
+	}
+	if err == nil {
+		err = validateProjectsAutoDiscovery(projectsAutoDiscovery, projectsParents, projectsLabels)
+	}
+	projectsStates := []string{gcppromd.ProjectStateActive}
+	if raw := r.URL.Query().Get("projects-states"); err == nil && raw != "" {
+		projectsStates, err = gcppromd.ParseProjectStates(raw)
+	}
+	if err != nil {
+		return nil, nil, false, http.StatusBadRequest, err
+	}
 
-	var pexcludes *regexp.Regexp
+	pfilter := projectsFilter{Labels: projectsLabels, States: projectsStates}
+	if projectsInclude != "" {
+		pfilter.Include, err = regexp.Compile(projectsInclude)
+		if err != nil {
+			return nil, nil, false, http.StatusBadRequest, err
+		}
+	}
 	if projectsExclude != "" {
-		pexcludes, err = regexp.Compile(projectsExclude)
+		pfilter.Exclude, err = regexp.Compile(projectsExclude)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+			return nil, nil, false, http.StatusBadRequest, err
 		}
 	}
 
 	if projectsAutoDiscovery {
-		discovered, err := h.GCPProjectDiscovery.Projects(r.Context())
+		if h.GCPProjectDiscovery == nil {
+			return nil, nil, false, http.StatusInternalServerError, errors.New("projects auto-discovery is unavailable")
+		}
+		discovered, err := h.GCPProjectDiscovery.Projects(r.Context(), projectsParents)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, nil, false, http.StatusInternalServerError, err
+		}
+		projectsSet = projectsSetAddDiscovered(projectsSet, discovered)
+	}
+	projectsSet = projectsSetFilter(projectsSet, pfilter)
+
+	units := discoveryUnits(projectsSetList(projectsSet), sources, assetScopes)
+	results, ok := collectTargets(r.Context(), h.GCEDiscoveryWorkers, units, filter, opts)
+	configs, errs = mergeTargets(results)
+	return configs, errs, ok, http.StatusOK, nil
+}
+
+// errorsSummary describes the errors of a targets collection, one per line.
+func errorsSummary(errs []error) string {
+	lines := make([]string, 0, len(errs)+1)
+	lines = append(lines, fmt.Sprintf("targets discovery failed for %d project(s):", len(errs)))
+	for _, err := range errs {
+		lines = append(lines, err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// failedProjects returns the projects of the *gcppromd.ProjectError in errs.
+func failedProjects(errs []error) []string {
+	projects := make([]string, 0, len(errs))
+	seen := make(map[string]bool, len(errs))
+	for _, err := range errs {
+		if perr, ok := err.(*gcppromd.ProjectError); ok && !seen[perr.Project] {
+			seen[perr.Project] = true
+			projects = append(projects, perr.Project)
+		}
+	}
+	sort.Strings(projects)
+	return projects
+}
+
+// parseDiscoveryOptions extracts the discovery options from the query parameters.
+func parseDiscoveryOptions(query url.Values) (gcppromd.DiscoveryOptions, error) {
+	opts := gcppromd.DiscoveryOptions{
+		PresenceLabel:       query.Get("presence-label"),
+		PresenceValue:       query.Get("presence-value"),
+		AddressFamily:       query.Get("address-family"),
+		AddressMode:         query.Get("address-mode"),
+		CloudSQLExporter:    query.Get("cloudsql-exporter"),
+		MemorystoreExporter: query.Get("memorystore-exporter"),
+	}
+	if presenceFilter := strings.ToLower(query.Get("presence-filter")); presenceFilter == "false" || presenceFilter == "0" {
+		opts.DisablePresenceFilter = true
+	}
+	if gkePorts := query.Get("gke-ports"); gkePorts != "" {
+		ports, err := gcppromd.ParseNamedPorts(gkePorts)
+		if err != nil {
+			return opts, err
 		}
-		projectsSet = projectsSetAdd(projectsSet, discovered)
+		opts.GKEPorts = ports
+	}
+	return opts, opts.Validate()
+}
+
+func (h *handle) instancesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD": // allowed methods
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	errorsMode := strings.ToLower(r.URL.Query().Get("errors"))
+	switch errorsMode {
+	case "", errorsLenient, errorsStrict:
+	default:
+		http.Error(w, fmt.Sprintf("invalid errors mode %q, expected %q or %q", errorsMode, errorsLenient, errorsStrict), http.StatusBadRequest)
+		return
 	}
-	projectsSet = projectsSetExclude(projectsSet, pexcludes)
 
-	configs, _ := collectTargets(r.Context(), h.GCEDiscoveryWorkers, projectsSetList(projectsSet))
+	configs, errs, _, status, err := h.discover(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if len(errs) > 0 {
+		if errorsMode == errorsStrict {
+			http.Error(w, errorsSummary(errs), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set(headerDiscoveryErrors, strconv.Itoa(len(errs)))
+		w.Header().Set(headerFailedProjects, strings.Join(failedProjects(errs), projectSeparator))
+	}
 
 	buf := &bytes.Buffer{}
 	enc := json.NewEncoder(buf)
@@ -383,3 +952,42 @@ func (h *handle) instancesHandler(w http.ResponseWriter, r *http.Request) {
 		log.WithError(err).Error("unexpected error while witting response")
 	}
 }
+
+// httpSDHandler serves the targets following the Prometheus HTTP service discovery specification
+// https://prometheus.io/docs/prometheus/latest/http_sd/. Any failure to refresh the targets is answered with a
+// non-200 status code, so that Prometheus keeps its current targets list.
+func (h *handle) httpSDHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD": // allowed methods
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	configs, errs, ok, status, err := h.discover(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if !ok {
+		http.Error(w, "targets discovery did not complete", http.StatusServiceUnavailable)
+		return
+	}
+	if len(errs) > 0 {
+		http.Error(w, errorsSummary(errs), http.StatusBadGateway)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	if err := json.NewEncoder(buf).Encode(configs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		log.WithError(err).Error("unexpected error while witting response")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/messagebird/gcppromd"
+)
+
+func TestProjectsSetAddDiscovered(t *testing.T) {
+	explicit := projectsSetAdd(ProjectsSet{}, []string{"project-a"})
+	refreshes := []struct {
+		discovered []*gcppromd.Project
+		want       []string
+	}{
+		{discovered: []*gcppromd.Project{{ID: "project-a"}, {ID: "project-b"}, {ID: "project-c"}}, want: []string{"project-a", "project-b", "project-c"}},
+		// project-c was deleted or moved out of the parents
+		{discovered: []*gcppromd.Project{{ID: "project-b"}}, want: []string{"project-a", "project-b"}},
+		{discovered: nil, want: []string{"project-a"}},
+	}
+	for n, refresh := range refreshes {
+		projects := projectsSetAddDiscovered(explicit, refresh.discovered)
+		got := projectsSetList(projects)
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, refresh.want) {
+			t.Errorf("refresh #%d: projects = %v, want %v", n, got, refresh.want)
+		}
+		if projects["project-a"] != nil {
+			t.Errorf("refresh #%d: the explicit project-a was replaced by the discovered one", n)
+		}
+	}
+	if len(explicit) != 1 {
+		t.Errorf("projectsSetAddDiscovered() modified the explicit projects: %v", explicit)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "gcppromd"
+
+var (
+	discoveryQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "discovery_queue_depth",
+		Help:      "Number of discovery requests waiting for a worker of the pool.",
+	})
+	daemonLastWrite = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "daemon_last_write_timestamp_seconds",
+		Help:      "Unix timestamp of the last successful write of the targets file.",
+	}, []string{"output"})
+	daemonStaleProjects = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "daemon_stale_projects",
+		Help:      "Number of projects whose last known targets were written because their discovery failed.",
+	}, []string{"output"})
+	daemonRefusedWrites = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "daemon_refused_writes_total",
+		Help:      "Number of targets files not written because the number of targets dropped too much.",
+	}, []string{"output"})
+	daemonConsecutiveRefusals = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "daemon_consecutive_refused_writes",
+		Help:      "Number of consecutive refreshes whose targets file was not written because the number of targets dropped too much.",
+	}, []string{"output"})
+)
@@ -0,0 +1,282 @@
+package gcppromd
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+	"google.golang.org/api/pubsub/v1"
+)
+
+const (
+	// feedPullMaxMessages is the maximum number of messages returned by a pull
+	feedPullMaxMessages = 100
+	// pubSubEmulatorHostEnv is the environment variable giving the address of the Pub/Sub emulator, the
+	// subscriptions are pulled from it without credentials when it is set
+	pubSubEmulatorHostEnv = "PUBSUB_EMULATOR_HOST"
+)
+
+// FeedMessage is a message published by a Cloud Asset Inventory feed.
+type FeedMessage struct {
+	AckID string
+	Data  []byte
+}
+
+// FeedSubscription pulls the messages of a Cloud Asset Inventory feed, see NewPubSubSubscription.
+type FeedSubscription interface {
+	// Pull waits for messages, it may return no message
+	Pull(ctx context.Context) ([]*FeedMessage, error)
+	// Acknowledge removes the messages from the subscription
+	Acknowledge(ctx context.Context, ackIDs []string) error
+}
+
+// pubSubSubscription is a FeedSubscription pulling a Pub/Sub subscription.
+type pubSubSubscription struct {
+	service *pubsub.Service
+	name    string
+}
+
+// NewPubSubSubscription returns the FeedSubscription of the Pub/Sub subscription
+// projects/<project>/subscriptions/<name>. The Pub/Sub emulator is used when PUBSUB_EMULATOR_HOST is set.
+func NewPubSubSubscription(ctx context.Context, subscription string) (FeedSubscription, error) {
+	if err := ValidateSubscription(subscription); err != nil {
+		return nil, err
+	}
+
+	var opts []option.ClientOption
+	if host := os.Getenv(pubSubEmulatorHostEnv); host != "" {
+		opts = append(opts, option.WithEndpoint("http://"+host+"/"), option.WithoutAuthentication())
+	} else {
+		cl, err := newClient(ctx, pubsub.PubsubScope)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, option.WithHTTPClient(cl))
+	}
+
+	service, err := pubsub.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &pubSubSubscription{service: service, name: subscription}, nil
+}
+
+// ValidateSubscription checks that subscription is a Pub/Sub subscription name,
+// projects/<project>/subscriptions/<name>.
+func ValidateSubscription(subscription string) error {
+	segments := strings.Split(subscription, "/")
+	if len(segments) != 4 || segments[0] != "projects" || segments[2] != "subscriptions" || segments[1] == "" || segments[3] == "" {
+		return fmt.Errorf("invalid subscription %q, expected projects/<project>/subscriptions/<name>", subscription)
+	}
+	return nil
+}
+
+func (s *pubSubSubscription) Pull(ctx context.Context) ([]*FeedMessage, error) {
+	resp, err := s.service.Projects.Subscriptions.
+		Pull(s.name, &pubsub.PullRequest{MaxMessages: feedPullMaxMessages}).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]*FeedMessage, 0, len(resp.ReceivedMessages))
+	for _, received := range resp.ReceivedMessages {
+		message := &FeedMessage{AckID: received.AckId}
+		if received.Message != nil {
+			// undecodable data is left empty, the message is then reported as invalid
+			message.Data, _ = base64.StdEncoding.DecodeString(received.Message.Data)
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+func (s *pubSubSubscription) Acknowledge(ctx context.Context, ackIDs []string) error {
+	_, err := s.service.Projects.Subscriptions.
+		Acknowledge(s.name, &pubsub.AcknowledgeRequest{AckIds: ackIDs}).
+		Context(ctx).
+		Do()
+	return err
+}
+
+// InstanceEvent is a change of a GCE instance published by a Cloud Asset Inventory feed.
+type InstanceEvent struct {
+	// Project, Zone and Name identify the instance
+	Project string
+	Zone    string
+	Name    string
+	// Time of the change
+	Time time.Time
+	// Deleted is true when the instance was deleted or doesn't carry the presence label anymore
+	Deleted bool
+	// Configs are the targets of the instance when it isn't deleted
+	Configs []*PromConfig
+}
+
+// Key identifies the instance of the event, see InstanceKey.
+func (e *InstanceEvent) Key() string {
+	return e.Project + "/" + e.Zone + "/" + e.Name
+}
+
+// InstanceKey returns the key of the instance a target built by the gce or asset-inventory sources belongs to, as
+// returned by InstanceEvent.Key, false when it doesn't belong to an instance, e.g. a delegated host.
+func InstanceKey(config *PromConfig) (string, bool) {
+	name, ok := config.Labels[promLabelInstanceName]
+	if !ok {
+		return "", false
+	}
+	zone := lastPathSegment(string(config.Labels[promLabelZone]))
+	return string(config.Labels[promLabelProject]) + "/" + zone + "/" + string(name), true
+}
+
+// eventMIGLabels are the managed instance groups labels the targets of an event can't have, they are looked up by
+// the collections only.
+var eventMIGLabels = []pmodel.LabelName{
+	promLabelInstanceTemplate,
+	promLabelAutoscaler,
+	promLabelAutoscalerMode,
+	promLabelAutoscalerMinSize,
+	promLabelAutoscalerMaxSize,
+}
+
+// WithMIGLabels returns the targets of the event with the managed instance groups labels of the last known targets of
+// the instance, as long as it belongs to the same instance group. The targets of the event aren't modified.
+func (e *InstanceEvent) WithMIGLabels(previous []*PromConfig) []*PromConfig {
+	var last pmodel.LabelSet
+	for _, config := range previous {
+		if _, ok := config.Labels[promLabelInstanceGroup]; ok {
+			last = config.Labels
+			break
+		}
+	}
+	if last == nil {
+		return e.Configs
+	}
+
+	configs := make([]*PromConfig, 0, len(e.Configs))
+	for _, config := range e.Configs {
+		if group, ok := config.Labels[promLabelInstanceGroup]; !ok || group != last[promLabelInstanceGroup] {
+			configs = append(configs, config)
+			continue
+		}
+		labels := config.Labels.Clone()
+		for _, name := range eventMIGLabels {
+			if _, ok := labels[name]; ok {
+				continue
+			}
+			if value, ok := last[name]; ok {
+				labels[name] = value
+			}
+		}
+		configs = append(configs, &PromConfig{Targets: config.Targets, Labels: labels})
+	}
+	return configs
+}
+
+// temporalAsset is the content of the messages published by a Cloud Asset Inventory feed.
+type temporalAsset struct {
+	Asset *struct {
+		Name      string `json:"name"`
+		AssetType string `json:"assetType"`
+		Resource  *struct {
+			Version string          `json:"version"`
+			Data    json.RawMessage `json:"data"`
+		} `json:"resource"`
+	} `json:"asset"`
+	Window *struct {
+		StartTime time.Time `json:"startTime"`
+	} `json:"window"`
+	Deleted bool `json:"deleted"`
+}
+
+// ParseAssetFeedMessage returns the instance change published in a message of a Cloud Asset Inventory feed, nil when
+// the message is about another type of asset. The targets of the instance are built like the gce source does,
+// without the managed instance groups labels that aren't in its metadata, see InstanceEvent.WithMIGLabels.
+func ParseAssetFeedMessage(data []byte, opts DiscoveryOptions) (*InstanceEvent, error) {
+	var ta temporalAsset
+	if err := json.Unmarshal(data, &ta); err != nil {
+		return nil, fmt.Errorf("decoding feed message: %v", err)
+	}
+	if ta.Asset == nil {
+		return nil, fmt.Errorf("feed message without asset")
+	}
+	if ta.Asset.AssetType != assetTypeInstance {
+		return nil, nil
+	}
+
+	// the name of an instance is //compute.googleapis.com/projects/<project>/zones/<zone>/instances/<name>
+	segments := strings.Split(ta.Asset.Name, "/")
+	if len(segments) != 9 || segments[3] != "projects" || segments[5] != "zones" {
+		return nil, fmt.Errorf("unexpected instance asset name %s", ta.Asset.Name)
+	}
+	event := &InstanceEvent{Project: segments[4], Zone: segments[6], Name: segments[8], Deleted: true}
+	if ta.Window != nil {
+		event.Time = ta.Window.StartTime
+	}
+	if ta.Deleted || ta.Asset.Resource == nil {
+		return event, nil
+	}
+	if ta.Asset.Resource.Version != assetInstanceVersion {
+		return nil, fmt.Errorf("instance asset %s: unexpected resource version %q", ta.Asset.Name, ta.Asset.Resource.Version)
+	}
+
+	inst := &compute.Instance{}
+	if err := json.Unmarshal(ta.Asset.Resource.Data, inst); err != nil {
+		return nil, fmt.Errorf("decoding instance asset %s: %v", ta.Asset.Name, err)
+	}
+	if !opts.matchesPresence(inst.Labels) {
+		return event, nil
+	}
+	delagatedHosts := make(map[string]*delagatedHost)
+	event.Configs = instanceConfigs(event.Project, inst, opts, nil, delagatedHosts)
+	event.Deleted = false
+	return event, nil
+}
+
+// WatchAssetFeed pulls the messages of a Cloud Asset Inventory feed and calls handle with the instance changes they
+// publish, or with the error of a message that can't be parsed. The messages are acknowledged once handled. It
+// returns when ctx is done or the subscription fails.
+func WatchAssetFeed(ctx context.Context, sub FeedSubscription, opts DiscoveryOptions, handle func(*InstanceEvent, error)) error {
+	for {
+		messages, err := sub.Pull(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			continue
+		}
+
+		ackIDs := make([]string, 0, len(messages))
+		for _, message := range messages {
+			event, err := ParseAssetFeedMessage(message.Data, opts)
+			switch {
+			case err != nil:
+				feedEvents.WithLabelValues("invalid").Inc()
+				handle(nil, err)
+			case event == nil:
+				feedEvents.WithLabelValues("ignored").Inc()
+			case event.Deleted:
+				feedEvents.WithLabelValues("delete").Inc()
+				handle(event, nil)
+			default:
+				feedEvents.WithLabelValues("update").Inc()
+				handle(event, nil)
+			}
+			ackIDs = append(ackIDs, message.AckID)
+		}
+		if err := sub.Acknowledge(ctx, ackIDs); err != nil && ctx.Err() == nil {
+			return err
+		}
+	}
+}
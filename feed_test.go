@@ -0,0 +1,272 @@
+package gcppromd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+)
+
+// fakeSubscription is a FeedSubscription returning its messages on the first pull, then blocking until ctx is done.
+type fakeSubscription struct {
+	mu       sync.Mutex
+	messages []*FeedMessage
+	pullErr  error
+	acked    []string
+}
+
+func (s *fakeSubscription) Pull(ctx context.Context) ([]*FeedMessage, error) {
+	s.mu.Lock()
+	messages, err := s.messages, s.pullErr
+	s.messages, s.pullErr = nil, nil
+	s.mu.Unlock()
+	if err != nil || len(messages) > 0 {
+		return messages, err
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (s *fakeSubscription) Acknowledge(ctx context.Context, ackIDs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acked = append(s.acked, ackIDs...)
+	return nil
+}
+
+// instanceAssetMessage returns a feed message of the instance project-a/europe-west4-a/<name>.
+func instanceAssetMessage(t *testing.T, name string, labels map[string]string, deleted bool, start time.Time) []byte {
+	t.Helper()
+	instance := map[string]interface{}{
+		"name":   name,
+		"zone":   "https://www.googleapis.com/compute/v1/projects/project-a/zones/europe-west4-a",
+		"labels": labels,
+		"status": "RUNNING",
+		"networkInterfaces": []map[string]interface{}{
+			{"name": "nic0", "networkIP": "10.0.0.2"},
+		},
+		"metadata": map[string]interface{}{
+			"items": []map[string]interface{}{{"key": "prometheus_ports", "value": "9100"}},
+		},
+	}
+	data, err := json.Marshal(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := map[string]interface{}{
+		"asset": map[string]interface{}{
+			"name":      "//compute.googleapis.com/projects/project-a/zones/europe-west4-a/instances/" + name,
+			"assetType": assetTypeInstance,
+			"resource":  map[string]interface{}{"version": assetInstanceVersion, "data": json.RawMessage(data)},
+		},
+		"window":  map[string]interface{}{"startTime": start.Format(time.RFC3339Nano)},
+		"deleted": deleted,
+	}
+	if deleted {
+		delete(message["asset"].(map[string]interface{}), "resource")
+	}
+	raw, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestParseAssetFeedMessage(t *testing.T) {
+	start := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	opts := DiscoveryOptions{}
+
+	tests := []struct {
+		name        string
+		data        []byte
+		wantNil     bool
+		wantErr     bool
+		wantDeleted bool
+		wantTargets []string
+	}{
+		{
+			name:        "update",
+			data:        instanceAssetMessage(t, "vm-1", map[string]string{DefaultPresenceLabel: ""}, false, start),
+			wantTargets: []string{"10.0.0.2:9100"},
+		},
+		{
+			name:        "delete",
+			data:        instanceAssetMessage(t, "vm-1", nil, true, start),
+			wantDeleted: true,
+		},
+		{
+			name:        "presence label removed",
+			data:        instanceAssetMessage(t, "vm-1", map[string]string{"env": "prod"}, false, start),
+			wantDeleted: true,
+		},
+		{
+			name:    "not an instance",
+			data:    []byte(`{"asset":{"name":"//compute.googleapis.com/projects/project-a/global/networks/default","assetType":"compute.googleapis.com/Network"}}`),
+			wantNil: true,
+		},
+		{
+			name:    "invalid json",
+			data:    []byte(`{`),
+			wantErr: true,
+		},
+		{
+			name:    "unexpected name",
+			data:    []byte(`{"asset":{"name":"//compute.googleapis.com/projects/project-a/instances/vm-1","assetType":"compute.googleapis.com/Instance"}}`),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := ParseAssetFeedMessage(tt.data, opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAssetFeedMessage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if (event == nil) != tt.wantNil {
+				t.Fatalf("ParseAssetFeedMessage() = %+v, want nil %v", event, tt.wantNil)
+			}
+			if event == nil {
+				return
+			}
+			if event.Key() != "project-a/europe-west4-a/vm-1" {
+				t.Errorf("Key() = %s", event.Key())
+			}
+			if !event.Time.Equal(start) {
+				t.Errorf("Time = %v, want %v", event.Time, start)
+			}
+			if event.Deleted != tt.wantDeleted {
+				t.Errorf("Deleted = %v, want %v", event.Deleted, tt.wantDeleted)
+			}
+			var targets []string
+			for _, config := range event.Configs {
+				targets = append(targets, config.Targets...)
+				if key, ok := InstanceKey(config); !ok || key != event.Key() {
+					t.Errorf("InstanceKey() = %s, %v, want %s", key, ok, event.Key())
+				}
+			}
+			if !reflect.DeepEqual(targets, tt.wantTargets) {
+				t.Errorf("targets = %v, want %v", targets, tt.wantTargets)
+			}
+		})
+	}
+}
+
+func TestInstanceEventWithMIGLabels(t *testing.T) {
+	collected := []*PromConfig{{
+		Targets: []string{"10.0.0.2:9100"},
+		Labels: pmodel.LabelSet{
+			promLabelInstanceGroup:     "mig-a",
+			promLabelInstanceTemplate:  "template-1",
+			promLabelAutoscaler:        "autoscaler-a",
+			promLabelAutoscalerMode:    "ON",
+			promLabelAutoscalerMinSize: "1",
+			promLabelAutoscalerMaxSize: "5",
+		},
+	}}
+	tests := []struct {
+		name   string
+		labels pmodel.LabelSet
+		want   pmodel.LabelSet
+	}{
+		{
+			name:   "same group",
+			labels: pmodel.LabelSet{promLabelInstanceGroup: "mig-a"},
+			want:   collected[0].Labels,
+		},
+		{
+			name:   "template from the metadata",
+			labels: pmodel.LabelSet{promLabelInstanceGroup: "mig-a", promLabelInstanceTemplate: "template-2"},
+			want: pmodel.LabelSet{
+				promLabelInstanceGroup:     "mig-a",
+				promLabelInstanceTemplate:  "template-2",
+				promLabelAutoscaler:        "autoscaler-a",
+				promLabelAutoscalerMode:    "ON",
+				promLabelAutoscalerMinSize: "1",
+				promLabelAutoscalerMaxSize: "5",
+			},
+		},
+		{
+			name:   "other group",
+			labels: pmodel.LabelSet{promLabelInstanceGroup: "mig-b"},
+			want:   pmodel.LabelSet{promLabelInstanceGroup: "mig-b"},
+		},
+		{
+			name:   "not in a group",
+			labels: pmodel.LabelSet{},
+			want:   pmodel.LabelSet{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			labels := tt.labels.Clone()
+			event := &InstanceEvent{Configs: []*PromConfig{{Targets: []string{"10.0.0.2:9100"}, Labels: labels}}}
+			configs := event.WithMIGLabels(collected)
+			if len(configs) != 1 || !reflect.DeepEqual(configs[0].Labels, tt.want) {
+				t.Errorf("WithMIGLabels() = %v, want %v", configs[0].Labels, tt.want)
+			}
+			if !reflect.DeepEqual(labels, tt.labels) {
+				t.Errorf("WithMIGLabels() modified the labels of the event: %v", labels)
+			}
+		})
+	}
+
+	event := &InstanceEvent{Configs: collected}
+	if configs := event.WithMIGLabels(nil); !reflect.DeepEqual(configs, collected) {
+		t.Errorf("WithMIGLabels(nil) = %v, want the targets of the event", configs)
+	}
+}
+
+func TestWatchAssetFeed(t *testing.T) {
+	start := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	sub := &fakeSubscription{messages: []*FeedMessage{
+		{AckID: "1", Data: instanceAssetMessage(t, "vm-1", map[string]string{DefaultPresenceLabel: ""}, false, start)},
+		{AckID: "2", Data: []byte(`{"asset":{"name":"n","assetType":"compute.googleapis.com/Disk"}}`)},
+		{AckID: "3", Data: []byte(`not json`)},
+		{AckID: "4", Data: instanceAssetMessage(t, "vm-1", nil, true, start.Add(time.Minute))},
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var events []*InstanceEvent
+	var errs []error
+	handle := func(event *InstanceEvent, err error) {
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			events = append(events, event)
+		}
+		if len(events)+len(errs) == 3 {
+			cancel()
+		}
+	}
+	if err := WatchAssetFeed(ctx, sub, DiscoveryOptions{}, handle); err != nil {
+		t.Fatalf("WatchAssetFeed() = %v", err)
+	}
+
+	if len(events) != 2 || events[0].Deleted || !events[1].Deleted {
+		t.Errorf("events = %+v, want an update then a delete", events)
+	}
+	if len(errs) != 1 {
+		t.Errorf("errors = %v, want the invalid message", errs)
+	}
+	if want := []string{"1", "2", "3", "4"}; !reflect.DeepEqual(sub.acked, want) {
+		t.Errorf("acknowledged %v, want %v", sub.acked, want)
+	}
+}
+
+func TestWatchAssetFeedPullError(t *testing.T) {
+	pullErr := errors.New("subscription not found")
+	sub := &fakeSubscription{pullErr: pullErr}
+	err := WatchAssetFeed(context.Background(), sub, DiscoveryOptions{}, func(*InstanceEvent, error) {
+		t.Error("unexpected message")
+	})
+	if err != pullErr {
+		t.Errorf("WatchAssetFeed() = %v, want %v", err, pullErr)
+	}
+}
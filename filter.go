@@ -0,0 +1,258 @@
+package gcppromd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// filterOperators are the comparison operators of the GCE API filters, the longest first.
+var filterOperators = []string{"!=", ">=", "<=", "=", ">", "<", ":"}
+
+// ValidateFilter checks the syntax of a filter of the GCE API list methods, see
+// https://cloud.google.com/compute/docs/reference/rest/v1/instances/aggregatedList#body.QUERY_PARAMETERS.filter
+// The filter is either a sequence of comparisons "<field> <operator> <value>" with the =, !=, >, <, >=, <= and :
+// operators, optionally grouped in parentheses, negated and joined with AND or OR, or a sequence of eq and ne
+// comparisons whose values are RE2 regular expressions, each one in parentheses when there are several. The API
+// doesn't accept both syntaxes in the same filter.
+func ValidateFilter(filter string) error {
+	_, err := parseFilter(filter)
+	return err
+}
+
+func parseFilter(filter string) (*filterParser, error) {
+	p := &filterParser{in: filter}
+	err := p.sequence(0)
+	switch {
+	case err != nil:
+	case p.regexp && p.expression:
+		err = fmt.Errorf("the eq and ne operators can't be combined with the =, !=, >, <, : operators nor AND, OR, NOT")
+	case p.regexp && p.terms > 1 && p.bare > 0:
+		err = fmt.Errorf("the eq and ne comparisons must each be in parentheses")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %v", filter, err)
+	}
+	return p, nil
+}
+
+// isRegexpFilter reports whether a valid filter uses the eq and ne regular expressions syntax. An empty filter uses
+// both syntaxes.
+func isRegexpFilter(filter string) bool {
+	p, err := parseFilter(filter)
+	return err == nil && (p.regexp || !p.expression)
+}
+
+// labelExistsFilter returns the filter matching the resources carrying a label, in the regular expressions syntax or
+// not.
+func labelExistsFilter(label string, regexp bool) string {
+	if regexp {
+		return fmt.Sprintf("(labels.%s eq .*)", label)
+	}
+	return fmt.Sprintf("labels.%s:*", label)
+}
+
+// combineFilters joins filters of the same syntax. The regular expressions filters are space-separated parenthesized
+// comparisons, the API rejects AND between them, the other filters are parenthesized and joined with AND.
+func combineFilters(filters ...string) string {
+	regexp := true
+	for _, f := range filters {
+		regexp = regexp && isRegexpFilter(f)
+	}
+
+	parts := make([]string, 0, len(filters))
+	for _, f := range filters {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !regexp || !strings.HasPrefix(f, "(") {
+			f = "(" + f + ")"
+		}
+		parts = append(parts, f)
+	}
+	if regexp {
+		return strings.Join(parts, " ")
+	}
+	return strings.Join(parts, " AND ")
+}
+
+type filterParser struct {
+	in  string
+	pos int
+	// regexp and expression are set when the filter uses the eq and ne operators, and when it uses the other
+	// operators or the logical ones
+	regexp     bool
+	expression bool
+	// terms and bare are the numbers of terms and of comparisons that aren't in parentheses, at the top level
+	terms int
+	bare  int
+}
+
+func (p *filterParser) skipSpaces() {
+	for p.pos < len(p.in) && isFilterSpace(p.in[p.pos]) {
+		p.pos++
+	}
+}
+
+func isFilterSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// keyword consumes the keyword kw when it is the next word of the input.
+func (p *filterParser) keyword(kw string) bool {
+	end := p.pos + len(kw)
+	if !strings.HasPrefix(p.in[p.pos:], kw) {
+		return false
+	}
+	if end < len(p.in) && !isFilterSpace(p.in[end]) && p.in[end] != '(' {
+		return false
+	}
+	p.pos = end
+	return true
+}
+
+// sequence parses terms until the end of the input or, in a group, until its closing parenthesis.
+func (p *filterParser) sequence(depth int) error {
+	terms := 0
+	for {
+		p.skipSpaces()
+		if p.pos >= len(p.in) {
+			if depth > 0 {
+				return fmt.Errorf("missing closing parenthesis")
+			}
+			return nil
+		}
+		if p.in[p.pos] == ')' {
+			if depth == 0 {
+				return fmt.Errorf("unexpected closing parenthesis at %d", p.pos)
+			}
+			if terms == 0 {
+				return fmt.Errorf("empty parentheses at %d", p.pos)
+			}
+			p.pos++
+			return nil
+		}
+
+		if terms > 0 && (p.keyword("AND") || p.keyword("OR")) {
+			p.expression = true
+			p.skipSpaces()
+			if p.pos >= len(p.in) || p.in[p.pos] == ')' {
+				return fmt.Errorf("missing expression after logical operator at %d", p.pos)
+			}
+		}
+		if depth == 0 {
+			p.terms++
+			if p.in[p.pos] != '(' {
+				p.bare++
+			}
+		}
+		if err := p.term(depth); err != nil {
+			return err
+		}
+		terms++
+	}
+}
+
+// term parses a possibly negated comparison or group.
+func (p *filterParser) term(depth int) error {
+	if p.keyword("NOT") {
+		p.expression = true
+		p.skipSpaces()
+	} else if p.in[p.pos] == '-' {
+		p.expression = true
+		p.pos++
+	}
+	if p.pos < len(p.in) && p.in[p.pos] == '(' {
+		p.pos++
+		return p.sequence(depth + 1)
+	}
+	return p.comparison()
+}
+
+var filterFieldRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.\-]*`)
+
+func (p *filterParser) comparison() error {
+	field := filterFieldRE.FindString(p.in[p.pos:])
+	if field == "" {
+		return fmt.Errorf("expected a field name at %d", p.pos)
+	}
+	p.pos += len(field)
+	p.skipSpaces()
+
+	operator := ""
+	for _, op := range filterOperators {
+		if strings.HasPrefix(p.in[p.pos:], op) {
+			operator = op
+			p.pos += len(op)
+			break
+		}
+	}
+	if operator == "" {
+		for _, op := range []string{"eq", "ne"} {
+			if p.keyword(op) {
+				operator = op
+				break
+			}
+		}
+	}
+	if operator == "" {
+		return fmt.Errorf("expected a comparison operator after the field %q at %d", field, p.pos)
+	}
+	p.skipSpaces()
+
+	value, err := p.value()
+	if err != nil {
+		return fmt.Errorf("field %q: %v", field, err)
+	}
+	if operator == "eq" || operator == "ne" {
+		p.regexp = true
+		if _, err := regexp.Compile(value); err != nil {
+			return fmt.Errorf("field %q: invalid regular expression: %v", field, err)
+		}
+	} else {
+		p.expression = true
+	}
+	return nil
+}
+
+// value parses a quoted value or a value running until the next space or unbalanced closing parenthesis.
+func (p *filterParser) value() (string, error) {
+	if p.pos >= len(p.in) {
+		return "", fmt.Errorf("missing value")
+	}
+
+	if quote := p.in[p.pos]; quote == '"' || quote == '\'' {
+		var b strings.Builder
+		for i := p.pos + 1; i < len(p.in); i++ {
+			c := p.in[i]
+			if c == '\\' && i+1 < len(p.in) {
+				i++
+				b.WriteByte(p.in[i])
+				continue
+			}
+			if c == quote {
+				p.pos = i + 1
+				return b.String(), nil
+			}
+			b.WriteByte(c)
+		}
+		return "", fmt.Errorf("unterminated quoted value at %d", p.pos)
+	}
+
+	start, parens := p.pos, 0
+	for ; p.pos < len(p.in) && !isFilterSpace(p.in[p.pos]); p.pos++ {
+		if p.in[p.pos] == '(' {
+			parens++
+		} else if p.in[p.pos] == ')' {
+			if parens == 0 {
+				break
+			}
+			parens--
+		}
+	}
+	if p.pos == start {
+		return "", fmt.Errorf("missing value at %d", p.pos)
+	}
+	return p.in[start:p.pos], nil
+}
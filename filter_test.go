@@ -0,0 +1,89 @@
+package gcppromd
+
+import "testing"
+
+func TestValidateFilter(t *testing.T) {
+	tests := []struct {
+		filter  string
+		wantErr bool
+		regexp  bool
+	}{
+		{filter: "", regexp: true},
+		{filter: "labels.env eq prod", regexp: true},
+		{filter: `name ne "web-.*"`, regexp: true},
+		{filter: "(labels.env eq prod) (zone eq .*europe.*)", regexp: true},
+		{filter: "(labels.env eq prod)(zone ne us-.*)", regexp: true},
+		{filter: `(labels.env eq "a b")`, regexp: true},
+		{filter: "status = RUNNING"},
+		{filter: "labels.env:prod"},
+		{filter: "labels.env:*"},
+		{filter: "(a = b) OR (c = d)"},
+		{filter: "(a != b) AND (c >= 3)"},
+		{filter: "NOT labels.env = prod"},
+		{filter: "-labels.env = prod"},
+		{filter: "(a = b) (c = d)"},
+		{filter: "(a = (b))"},
+		{filter: "(a eq b) OR (c = d)", wantErr: true},
+		{filter: "(a eq b) AND (c eq d)", wantErr: true},
+		{filter: "(a eq b) (c = d)", wantErr: true},
+		{filter: "NOT a eq b", wantErr: true},
+		{filter: "a eq b c eq d", wantErr: true},
+		{filter: "(a eq b) c eq d", wantErr: true},
+		{filter: "a eq (", wantErr: true},
+		{filter: "a eq [", wantErr: true},
+		{filter: "(a = b", wantErr: true},
+		{filter: "a = b)", wantErr: true},
+		{filter: "()", wantErr: true},
+		{filter: "a = b AND", wantErr: true},
+		{filter: "a b", wantErr: true},
+		{filter: "a =", wantErr: true},
+		{filter: `a = "b`, wantErr: true},
+		{filter: "= b", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			err := ValidateFilter(tt.filter)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateFilter(%q) = %v, wantErr %v", tt.filter, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := isRegexpFilter(tt.filter); got != tt.regexp {
+				t.Errorf("isRegexpFilter(%q) = %v, want %v", tt.filter, got, tt.regexp)
+			}
+		})
+	}
+}
+
+func TestCombineFilters(t *testing.T) {
+	presence := DiscoveryOptions{}
+	presenceValue := DiscoveryOptions{PresenceValue: "yes|true"}
+	tests := []struct {
+		name   string
+		opts   DiscoveryOptions
+		filter string
+		want   string
+	}{
+		{name: "presence only", opts: presence, want: "(labels.prometheus eq .*)"},
+		{name: "presence value", opts: presenceValue, want: "(labels.prometheus eq yes|true)"},
+		{name: "no presence filter", opts: DiscoveryOptions{DisablePresenceFilter: true}, filter: "status = RUNNING", want: "(status = RUNNING)"},
+		{name: "no filters", opts: DiscoveryOptions{DisablePresenceFilter: true}, want: ""},
+		{name: "bare regexp", opts: presence, filter: "labels.env eq prod", want: "(labels.prometheus eq .*) (labels.env eq prod)"},
+		{name: "regexp groups", opts: presence, filter: "(labels.env eq prod) (zone eq .*-a)", want: "(labels.prometheus eq .*) (labels.env eq prod) (zone eq .*-a)"},
+		{name: "expression", opts: presenceValue, filter: "status = RUNNING", want: "(labels.prometheus:*) AND (status = RUNNING)"},
+		{name: "has expression", opts: presence, filter: "labels.env:prod", want: "(labels.prometheus:*) AND (labels.env:prod)"},
+		{name: "parenthesized or", opts: presence, filter: "(a = b) OR (c = d)", want: "(labels.prometheus:*) AND ((a = b) OR (c = d))"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := combineFilters(tt.opts.presenceFilter(isRegexpFilter(tt.filter)), tt.filter)
+			if got != tt.want {
+				t.Errorf("combineFilters() = %q, want %q", got, tt.want)
+			}
+			if err := ValidateFilter(got); err != nil {
+				t.Errorf("combined filter %q is invalid: %v", got, err)
+			}
+		})
+	}
+}
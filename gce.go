@@ -3,12 +3,16 @@ package gcppromd
 import (
 	"context"
 	"fmt"
+	"net"
+	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/prometheus/common/model"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/cloudresourcemanager/v1"
+	crmv3 "google.golang.org/api/cloudresourcemanager/v3"
 	"google.golang.org/api/compute/v1"
 
 	pmodel "github.com/prometheus/common/model"
@@ -25,37 +29,74 @@ const (
 	promLabelSubnetwork       = promLabel + "subnetwork"
 	promLabelPublicIP         = promLabel + "public_ip"
 	promLabelPrivateIP        = promLabel + "private_ip"
+	promLabelPublicIPv6       = promLabel + "public_ipv6"
+	promLabelPrivateIPv6      = promLabel + "private_ipv6"
 	promLabelInstanceName     = promLabel + "instance_name"
 	promLabelInstanceStatus   = promLabel + "instance_status"
+	promLabelInstanceID       = promLabel + "instance_id"
+	promLabelMachineType      = promLabel + "machine_type"
+	promLabelCPUPlatform      = promLabel + "cpu_platform"
+	promLabelPreemptible      = promLabel + "preemptible"
+	promLabelProvisioning     = promLabel + "provisioning_model"
+	promLabelServiceAccounts  = promLabel + "service_accounts"
+	promLabelCreationTime     = promLabel + "creation_timestamp"
 	promLabelTags             = promLabel + "tags"
 	promLabelMetadata         = promLabel + "metadata_"
 	promLabelName             = promLabel + "name"
 	promLabelLabel            = promLabel + "label_"
 	promLabelDelegateForNames = promLabel + "delegate_for_instances"
+	promLabelInterface        = promLabel + "interface_"
+	promLabelTargetInterface  = promLabel + "interface"
+	promLabelInvalidMetadata  = promLabel + "invalid_metadata"
 	// separator used to join the GCE tag in one prom label or to declare
 	// multiple ports in the same gce metadata
 	promSeparator = ","
-	// filter to use to identify the instances scrapable by prometheus
-	promPresenceFilter = "(labels.prometheus eq .*)"
 	// Label prefixes scraped from GCE instance labels
 	gcePrefix              = "prometheus_"
 	gcePrefixPorts         = gcePrefix + "ports_"
 	gcePrefixDelegateAddr  = gcePrefix + "delegate_address_"
 	gcePrefixDelegatePorts = gcePrefix + "delegate_ports_"
+	gcePrefixInterface     = gcePrefix + "interface_"
+	gcePrefixAddressFamily = gcePrefix + "address_family_"
+	gcePrefixAddressMode   = gcePrefix + "address_mode_"
+	gcePrefixScheme        = gcePrefix + "scheme_"
+	gcePrefixPath          = gcePrefix + "path_"
+	gcePrefixParam         = gcePrefix + "param_"
 )
 
 // GCEReqInstanceDiscovery work unit for a pool of GCEDiscovery workers
 type GCEReqInstanceDiscovery struct {
+	// Project to discover, the organizations/<id> or folders/<id> scope of SourceAssetInventory
 	Project string
+	// Source of the targets, one of Sources, SourceGCE when empty
+	Source string
 	// Filter passed to the GCE API when looking up instances, see https://cloud.google.com/compute/docs/reference/rest/v1/acceleratorTypes/aggregatedList#body.QUERY_PARAMETERS.filter
 	Filter            string
+	Options           DiscoveryOptions
 	PrometheusConfigs chan []*PromConfig
 	Errors            chan error
 }
 
+// ProjectError is the error returned by the workers when the discovery of a project fails.
+type ProjectError struct {
+	Project string
+	Source  string
+	Err     error
+}
+
+func (e *ProjectError) Error() string {
+	return fmt.Sprintf("project %s (%s): %v", e.Project, e.Source, e.Err)
+}
+
+func (e *ProjectError) Unwrap() error {
+	return e.Err
+}
+
 // GCEDiscovery represents a Google Compute Engine discovery configuration for one Google project.
 type GCEDiscovery struct {
+	client  *http.Client
 	service *compute.Service
+	migs    migCache
 }
 
 type delagatedHost struct {
@@ -66,7 +107,7 @@ type delagatedHost struct {
 
 // NewGCEDiscoveryPool creates a pool <size> go routine to process the discovery requests in parallel.
 func NewGCEDiscoveryPool(ctx context.Context, size int) (chan *GCEReqInstanceDiscovery, error) {
-	gced, err := NewGCEDiscovery()
+	ds, err := newDiscoverers()
 	if err != nil {
 		return nil, err
 	}
@@ -82,10 +123,17 @@ func NewGCEDiscoveryPool(ctx context.Context, size int) (chan *GCEReqInstanceDis
 					if !ok {
 						return
 					}
-					confs, err := gced.Instances(ctx, req.Project, req.Filter)
+					if req.Source == "" {
+						req.Source = SourceGCE
+					}
+					started := time.Now()
+					confs, err := ds.discover(ctx, req)
+					discoveryDuration.WithLabelValues(req.Project, req.Source).Observe(time.Since(started).Seconds())
 					if err != nil {
-						req.Errors <- err
+						discoveryErrors.WithLabelValues(req.Project, req.Source).Inc()
+						req.Errors <- &ProjectError{Project: req.Project, Source: req.Source, Err: err}
 					} else {
+						discoveryTargets.WithLabelValues(req.Project, req.Source).Set(float64(CountTargets(confs)))
 						req.PrometheusConfigs <- confs
 					}
 				}
@@ -95,10 +143,21 @@ func NewGCEDiscoveryPool(ctx context.Context, size int) (chan *GCEReqInstanceDis
 	return reqs, nil
 }
 
+// newClient returns an HTTP client authenticated with the default credentials, the requests it sends are
+// accounted in the API metrics.
+func newClient(ctx context.Context, scope ...string) (*http.Client, error) {
+	cl, err := google.DefaultClient(ctx, scope...)
+	if err != nil {
+		return nil, err
+	}
+	cl.Transport = &instrumentedTransport{next: cl.Transport}
+	return cl, nil
+}
+
 // NewGCEDiscovery returns an object of GCEDiscovery type.
 func NewGCEDiscovery() (*GCEDiscovery, error) {
 	ctx := context.Background()
-	cl, err := google.DefaultClient(ctx, compute.CloudPlatformScope)
+	cl, err := newClient(ctx, compute.CloudPlatformScope)
 	if err != nil {
 		return nil, err
 	}
@@ -108,18 +167,20 @@ func NewGCEDiscovery() (*GCEDiscovery, error) {
 		return nil, err
 	}
 
-	d := GCEDiscovery{service: service}
+	d := GCEDiscovery{client: cl, service: service}
 
 	return &d, nil
 }
 
 type GCPProjectDiscovery struct {
 	service *cloudresourcemanager.Service
+	// v3 lists the projects and folders of a parent, used to walk organizations and folders
+	v3 *crmv3.Service
 }
 
 func NewGCPProjectDiscovery() (*GCPProjectDiscovery, error) {
 	ctx := context.Background()
-	cl, err := google.DefaultClient(ctx, cloudresourcemanager.CloudPlatformReadOnlyScope)
+	cl, err := newClient(ctx, cloudresourcemanager.CloudPlatformReadOnlyScope)
 	if err != nil {
 		return nil, err
 	}
@@ -129,172 +190,446 @@ func NewGCPProjectDiscovery() (*GCPProjectDiscovery, error) {
 		return nil, err
 	}
 
-	d := GCPProjectDiscovery{service: service}
+	v3, err := crmv3.New(cl)
+	if err != nil {
+		return nil, err
+	}
+
+	d := GCPProjectDiscovery{service: service, v3: v3}
 
 	return &d, nil
 }
 
-// DiscoverProjects discovers accessible projects in GCP
-func (d *GCPProjectDiscovery) Projects(ctx context.Context) (projects []string, err error) {
+// Projects discovers accessible projects in GCP, only the ones under the given organizations/<id> or folders/<id>
+// parents when there are some.
+func (d *GCPProjectDiscovery) Projects(ctx context.Context, parents []string) (projects []*Project, err error) {
+	if len(parents) > 0 {
+		projects, err = d.walkParents(ctx, parents)
+		if err != nil {
+			return nil, err
+		}
+		discoveryProjects.Set(float64(len(projects)))
+		return projects, nil
+	}
+
 	req := d.service.Projects.List()
 	if err := req.Pages(ctx, func(page *cloudresourcemanager.ListProjectsResponse) error {
 		for _, project := range page.Projects {
-			projects = append(projects, project.ProjectId)
+			projects = append(projects, &Project{
+				ID:     project.ProjectId,
+				Labels: project.Labels,
+				State:  project.LifecycleState,
+			})
 		}
 		return nil
 	}); err != nil {
 		return nil, err
 	}
+	discoveryProjects.Set(float64(len(projects)))
 
 	return
 }
 
 // Instances returns a list of instances of a directory project.
-func (d *GCEDiscovery) Instances(ctx context.Context, project, filter string) ([]*PromConfig, error) {
+func (d *GCEDiscovery) Instances(ctx context.Context, project, filter string, opts DiscoveryOptions) ([]*PromConfig, error) {
 	configs := make([]*PromConfig, 0, 100)
 	ialReq := d.service.Instances.
 		AggregatedList(project).
 		Fields(
 			"nextPageToken",
-			"items/*/instances(id,status,zone,name,tags,labels,networkInterfaces,selfLink,metadata)",
+			"items/*/instances(id,status,zone,name,tags,labels,networkInterfaces,selfLink,metadata,"+
+				"machineType,cpuPlatform,scheduling(preemptible,provisioningModel),serviceAccounts(email),creationTimestamp)",
 		)
 
-	filter = strings.TrimSpace(promPresenceFilter + " AND" + filter)
-	if filter[len(filter)-3:] == "AND" {
-		filter = filter[:len(filter)-3]
-	}
-	if filter != "" {
+	if filter = combineFilters(opts.presenceFilter(isRegexpFilter(filter)), filter); filter != "" {
 		ialReq = ialReq.Filter(filter)
 	}
 
 	delagatedHosts := make(map[string]*delagatedHost)
 
+	instances := make([]*compute.Instance, 0, 100)
 	err := ialReq.Pages(ctx, func(ial *compute.InstanceAggregatedList) error {
 		for _, zone := range ial.Items {
-			for _, inst := range zone.Instances {
-				if len(inst.NetworkInterfaces) <= 0 {
-					continue
-				}
+			instances = append(instances, zone.Instances...)
+		}
+		return nil
+	})
 
-				priIface := inst.NetworkInterfaces[0]
+	var migs map[string]*migInfo
+	if err == nil && hasMIGInstance(instances) {
+		migs = d.managedInstanceGroups(ctx, project)
+	}
+	for _, inst := range instances {
+		// the presence value isn't filtered by the API along with a filter without regular expressions
+		if !opts.matchesPresence(inst.Labels) {
+			continue
+		}
+		configs = append(configs, instanceConfigs(project, inst, opts, migs, delagatedHosts)...)
+	}
+	configs = append(configs, delegatedConfigs(delagatedHosts)...)
 
-				region := extractRegionFromZone(inst.Zone)
+	return configs, err
+}
 
-				labels := pmodel.LabelSet{
-					promLabelProject:        pmodel.LabelValue(project),
-					promLabelZone:           pmodel.LabelValue(inst.Zone),
-					promLabelRegion:         pmodel.LabelValue(region),
-					promLabelInstanceName:   pmodel.LabelValue(inst.Name),
-					promLabelInstanceStatus: pmodel.LabelValue(inst.Status),
-					promLabelNetwork:        pmodel.LabelValue(priIface.Network),
-					promLabelSubnetwork:     pmodel.LabelValue(priIface.Subnetwork),
-					promLabelPrivateIP:      pmodel.LabelValue(priIface.NetworkIP),
-				}
+// delegatedConfigs returns the targets of the delegated hosts declared by the instances.
+func delegatedConfigs(delagatedHosts map[string]*delagatedHost) []*PromConfig {
+	configs := make([]*PromConfig, 0, len(delagatedHosts))
+	for name, delegated := range delagatedHosts {
+		tags := promSeparator + strings.Join(delegated.delegateFor, promSeparator) + promSeparator
+		largetLables := pmodel.LabelSet{
+			promLabelDelegateForNames:      pmodel.LabelValue(tags),
+			model.LabelName(promLabelName): pmodel.LabelValue(name),
+		}
+
+		for _, port := range delegated.ports {
+			addr := []string{net.JoinHostPort(delegated.address, strconv.Itoa(port))}
+			pc := &PromConfig{addr, largetLables}
+			configs = append(configs, pc)
+		}
+	}
+	return configs
+}
 
-				if len(priIface.AccessConfigs) > 0 {
-					ac := priIface.AccessConfigs[0]
-					if ac.Type == "ONE_TO_ONE_NAT" {
-						labels[promLabelPublicIP] = pmodel.LabelValue(ac.NatIP)
+// instanceConfigs returns the targets declared by the metadata of an instance, the delegated hosts it declares are
+// recorded in delagatedHosts. migs are the managed instance groups of the project, if known.
+func instanceConfigs(project string, inst *compute.Instance, opts DiscoveryOptions, migs map[string]*migInfo, delagatedHosts map[string]*delagatedHost) []*PromConfig {
+	if len(inst.NetworkInterfaces) <= 0 {
+		return nil
+	}
+	configs := make([]*PromConfig, 0)
+
+	priIface := inst.NetworkInterfaces[0]
+
+	region := extractRegionFromZone(inst.Zone)
+
+	labels := pmodel.LabelSet{
+		promLabelProject:        pmodel.LabelValue(project),
+		promLabelZone:           pmodel.LabelValue(inst.Zone),
+		promLabelRegion:         pmodel.LabelValue(region),
+		promLabelInstanceName:   pmodel.LabelValue(inst.Name),
+		promLabelInstanceStatus: pmodel.LabelValue(inst.Status),
+		promLabelNetwork:        pmodel.LabelValue(priIface.Network),
+		promLabelSubnetwork:     pmodel.LabelValue(priIface.Subnetwork),
+		promLabelPrivateIP:      pmodel.LabelValue(priIface.NetworkIP),
+		promLabelInstanceID:     pmodel.LabelValue(strconv.FormatUint(inst.Id, 10)),
+		promLabelMachineType:    pmodel.LabelValue(lastPathSegment(inst.MachineType)),
+		promLabelCPUPlatform:    pmodel.LabelValue(inst.CpuPlatform),
+		promLabelCreationTime:   pmodel.LabelValue(inst.CreationTimestamp),
+	}
+
+	if inst.Scheduling != nil {
+		labels[promLabelPreemptible] = pmodel.LabelValue(strconv.FormatBool(inst.Scheduling.Preemptible))
+		if inst.Scheduling.ProvisioningModel != "" {
+			labels[promLabelProvisioning] = pmodel.LabelValue(inst.Scheduling.ProvisioningModel)
+		}
+	}
+
+	if len(inst.ServiceAccounts) > 0 {
+		emails := make([]string, 0, len(inst.ServiceAccounts))
+		for _, sa := range inst.ServiceAccounts {
+			emails = append(emails, sa.Email)
+		}
+		labels[promLabelServiceAccounts] = pmodel.LabelValue(promSeparator + strings.Join(emails, promSeparator) + promSeparator)
+	}
+
+	if ip := publicIP(priIface); ip != "" {
+		labels[promLabelPublicIP] = pmodel.LabelValue(ip)
+	}
+	if priIface.Ipv6Address != "" {
+		labels[promLabelPrivateIPv6] = pmodel.LabelValue(priIface.Ipv6Address)
+	}
+	if ip := publicIPv6(priIface); ip != "" {
+		labels[promLabelPublicIPv6] = pmodel.LabelValue(ip)
+	}
+
+	for n, iface := range inst.NetworkInterfaces {
+		prefix := promLabelInterface + strconv.Itoa(n) + "_"
+		labels[pmodel.LabelName(prefix+"name")] = pmodel.LabelValue(iface.Name)
+		labels[pmodel.LabelName(prefix+"ip")] = pmodel.LabelValue(iface.NetworkIP)
+		labels[pmodel.LabelName(prefix+"network")] = pmodel.LabelValue(iface.Network)
+		labels[pmodel.LabelName(prefix+"subnetwork")] = pmodel.LabelValue(iface.Subnetwork)
+		if ip := publicIP(iface); ip != "" {
+			labels[pmodel.LabelName(prefix+"public_ip")] = pmodel.LabelValue(ip)
+		}
+		if iface.Ipv6Address != "" {
+			labels[pmodel.LabelName(prefix+"ipv6")] = pmodel.LabelValue(iface.Ipv6Address)
+		}
+		if ip := publicIPv6(iface); ip != "" {
+			labels[pmodel.LabelName(prefix+"public_ipv6")] = pmodel.LabelValue(ip)
+		}
+	}
+
+	if inst.Tags != nil && len(inst.Tags.Items) > 0 {
+		// We surround the separated list with the separator as well. This way regular expressions
+		// in relabeling rules don't have to consider tag positions.
+		tags := promSeparator + strings.Join(inst.Tags.Items, promSeparator) + promSeparator
+		labels[promLabelTags] = pmodel.LabelValue(tags)
+	}
+
+	if inst.Labels != nil {
+		for key, v := range inst.Labels {
+			name := pstrutil.SanitizeLabelName(key)
+			labels[promLabelLabel+model.LabelName(name)] = model.LabelValue(v)
+		}
+	}
+
+	// GCE metadata are key-value pairs for user supplied attributes.
+	if inst.Metadata != nil {
+		metadata := make(map[string]string, len(inst.Metadata.Items))
+		for _, i := range inst.Metadata.Items {
+			// Protect against occasional nil pointers.
+			if i.Value != nil {
+				metadata[i.Key] = *i.Value
+			}
+		}
+
+		services := make([]string, 0)
+		for key := range metadata {
+			if strings.HasPrefix(key+"_", gcePrefixPorts) {
+				services = append(services, parseNameFromKey(key+"_", gcePrefixPorts))
+			}
+		}
+		params := parseParams(metadata, services)
+		migLabels(labels, metadata, migs)
+
+		// keep track of the locally created label set.
+		lTargetsLabels := make([]pmodel.LabelSet, 0)
+		// this loop do not populates the __meta_gce_metadata_...
+		// labels only generate the different targets.
+		for _, i := range inst.Metadata.Items {
+			if i.Value == nil {
+				continue
+			}
+			key, v := i.Key, *i.Value
+
+			paddedKey := key + "_" // pad the key with _ to match naked prefix
+			if ports, name, ok := parsePorts(paddedKey, v, gcePrefixPorts); ok {
+				iface := targetInterface(inst.NetworkInterfaces, metadata, name)
+				var invalid []string
+				family, key := addressMetadata(metadata, gcePrefixAddressFamily, name, opts.addressFamily(), AddressFamilyIPv4, AddressFamilyIPv6)
+				if key != "" {
+					invalid = append(invalid, key)
+				}
+				mode, key := addressMetadata(metadata, gcePrefixAddressMode, name, opts.addressMode(),
+					AddressModePrivate, AddressModePublic, AddressModeZonalDNS, AddressModeGlobalDNS)
+				if key != "" {
+					invalid = append(invalid, key)
+				}
+				host := targetHost(project, inst, iface, mode, family)
+				addrs := make([]string, 0, len(ports))
+				for _, port := range ports {
+					addr := net.JoinHostPort(host, strconv.Itoa(port))
+					addrs = append(addrs, addr)
+				}
+				targetLabels := labels.Clone()
+				targetLabels[model.LabelName(promLabelName)] = model.LabelValue(name)
+				targetLabels[promLabelTargetInterface] = model.LabelValue(iface.Name)
+				if len(invalid) > 0 {
+					targetLabels[promLabelInvalidMetadata] = model.LabelValue(promSeparator + strings.Join(invalid, promSeparator) + promSeparator)
+				}
+				if scheme := serviceMetadata(metadata, gcePrefixScheme, name, ""); scheme == "http" || scheme == "https" {
+					targetLabels[model.SchemeLabel] = model.LabelValue(scheme)
+				}
+				if path := serviceMetadata(metadata, gcePrefixPath, name, ""); path != "" {
+					if !strings.HasPrefix(path, "/") {
+						path = "/" + path
 					}
+					targetLabels[model.MetricsPathLabel] = model.LabelValue(path)
 				}
-
-				if inst.Tags != nil && len(inst.Tags.Items) > 0 {
-					// We surround the separated list with the separator as well. This way regular expressions
-					// in relabeling rules don't have to consider tag positions.
-					tags := promSeparator + strings.Join(inst.Tags.Items, promSeparator) + promSeparator
-					labels[promLabelTags] = pmodel.LabelValue(tags)
+				for param, v := range params[""] {
+					targetLabels[model.ParamLabelPrefix+model.LabelName(param)] = model.LabelValue(v)
 				}
-
-				if inst.Labels != nil {
-					for key, v := range inst.Labels {
-						name := pstrutil.SanitizeLabelName(key)
-						labels[promLabelLabel+model.LabelName(name)] = model.LabelValue(v)
+				if name != "" {
+					for param, v := range params[name] {
+						targetLabels[model.ParamLabelPrefix+model.LabelName(param)] = model.LabelValue(v)
 					}
 				}
+				pc := &PromConfig{addrs, targetLabels}
+				configs = append(configs, pc)
+				lTargetsLabels = append(lTargetsLabels, targetLabels)
+				continue
+			}
 
-				// GCE metadata are key-value pairs for user supplied attributes.
-				if inst.Metadata != nil {
-					// keep track of the locally created label set.
-					lTargetsLabels := make([]pmodel.LabelSet, 0)
-					// this loop do not populates the __meta_gce_metadata_...
-					// labels only generate the different targets.
-					for _, i := range inst.Metadata.Items {
-						// Protect against occasional nil pointers.
-						if i.Value == nil {
-							continue
-						}
-						key, v := i.Key, *i.Value
-
-						paddedKey := key + "_" // pad the key with _ to match naked prefix
-						if ports, name, ok := parsePorts(paddedKey, v, gcePrefixPorts); ok {
-							addrs := make([]string, 0, len(ports))
-							for _, port := range ports {
-								addr := fmt.Sprintf("%s:%d", priIface.NetworkIP, port)
-								addrs = append(addrs, addr)
-							}
-							targetLabels := labels.Clone()
-							targetLabels[model.LabelName(promLabelName)] = model.LabelValue(name)
-							pc := &PromConfig{addrs, targetLabels}
-							configs = append(configs, pc)
-							lTargetsLabels = append(lTargetsLabels, targetLabels)
-							continue
-						}
-
-						if ports, name, ok := parsePorts(paddedKey, v, gcePrefixDelegatePorts); ok {
-							if _, ok := delagatedHosts[name]; !ok {
-								delagatedHosts[name] = &delagatedHost{}
-							}
-							delagatedHosts[name].ports = ports
-							continue
-						}
-
-						if strings.HasPrefix(paddedKey, gcePrefixDelegateAddr) {
-							name := parseNameFromKey(paddedKey, gcePrefixDelegateAddr)
-							if _, ok := delagatedHosts[name]; !ok {
-								delagatedHosts[name] = &delagatedHost{}
-							}
-							delagatedHosts[name].address = v
-							delagatedHosts[name].delegateFor = append(
-								delagatedHosts[name].delegateFor,
-								inst.SelfLink,
-							)
-							continue
-						}
-					}
-					// populates cloned labels wiht the __meta_gce_metadata
-					for _, i := range inst.Metadata.Items {
-						if i.Value == nil {
-							continue
-						}
-						key, v := i.Key, *i.Value
-						for _, tlabels := range lTargetsLabels {
-							name := pstrutil.SanitizeLabelName(key)
-							tlabels[promLabelMetadata+model.LabelName(name)] = model.LabelValue(v)
-						}
-					}
+			if ports, name, ok := parsePorts(paddedKey, v, gcePrefixDelegatePorts); ok {
+				if _, ok := delagatedHosts[name]; !ok {
+					delagatedHosts[name] = &delagatedHost{}
 				}
+				delagatedHosts[name].ports = ports
+				continue
+			}
+
+			if strings.HasPrefix(paddedKey, gcePrefixDelegateAddr) {
+				name := parseNameFromKey(paddedKey, gcePrefixDelegateAddr)
+				if _, ok := delagatedHosts[name]; !ok {
+					delagatedHosts[name] = &delagatedHost{}
+				}
+				delagatedHosts[name].address = v
+				delagatedHosts[name].delegateFor = append(
+					delagatedHosts[name].delegateFor,
+					inst.SelfLink,
+				)
+				continue
 			}
 		}
-		return nil
-	})
+		// populates cloned labels wiht the __meta_gce_metadata
+		for key, v := range metadata {
+			for _, tlabels := range lTargetsLabels {
+				name := pstrutil.SanitizeLabelName(key)
+				tlabels[promLabelMetadata+model.LabelName(name)] = model.LabelValue(v)
+			}
+		}
+	}
 
-	// nolabels := pmodel.LabelSet{}
-	for name, delegated := range delagatedHosts {
-		tags := promSeparator + strings.Join(delegated.delegateFor, promSeparator) + promSeparator
-		largetLables := pmodel.LabelSet{
-			promLabelDelegateForNames:      pmodel.LabelValue(tags),
-			model.LabelName(promLabelName): pmodel.LabelValue(name),
+	return configs
+}
+
+// publicIP returns the external IP address of a network interface, if any.
+func publicIP(iface *compute.NetworkInterface) string {
+	if len(iface.AccessConfigs) > 0 {
+		ac := iface.AccessConfigs[0]
+		if ac.Type == "ONE_TO_ONE_NAT" {
+			return ac.NatIP
 		}
+	}
+	return ""
+}
 
-		for _, port := range delegated.ports {
-			addr := []string{fmt.Sprintf("%s:%d", delegated.address, port)}
-			fmt.Println(addr)
-			pc := &PromConfig{addr, largetLables}
-			configs = append(configs, pc)
+// publicIPv6 returns the external IPv6 address of a network interface, if any.
+func publicIPv6(iface *compute.NetworkInterface) string {
+	if len(iface.Ipv6AccessConfigs) > 0 {
+		return iface.Ipv6AccessConfigs[0].ExternalIpv6
+	}
+	return ""
+}
+
+// targetHost returns the host the targets of an instance are reached at through a network interface, given the address
+// mode and family of the targets.
+// The DNS modes resolve to the internal DNS names of the instance, the IP modes fall back to the other family when the
+// interface has no address of the requested one, and the public mode falls back to the private addresses when the
+// interface has no public address.
+func targetHost(project string, inst *compute.Instance, iface *compute.NetworkInterface, mode, family string) string {
+	switch mode {
+	case AddressModeZonalDNS:
+		return fmt.Sprintf("%s.%s.c.%s.internal", inst.Name, lastPathSegment(inst.Zone), dnsProject(project))
+	case AddressModeGlobalDNS:
+		return fmt.Sprintf("%s.c.%s.internal", inst.Name, dnsProject(project))
+	}
+
+	private := [2]string{iface.NetworkIP, iface.Ipv6Address}
+	public := [2]string{publicIP(iface), publicIPv6(iface)}
+	if family == AddressFamilyIPv6 {
+		private[0], private[1] = private[1], private[0]
+		public[0], public[1] = public[1], public[0]
+	}
+	candidates := append(private[:], public[:]...)
+	if mode == AddressModePublic {
+		candidates = append(public[:], private[:]...)
+	}
+	for _, ip := range candidates {
+		if ip != "" {
+			return ip
 		}
 	}
+	return ""
+}
 
-	return configs, err
+// dnsProject returns the project ID as it appears in the internal DNS names, domain-scoped projects like
+// example.com:project become project.example.com.
+func dnsProject(project string) string {
+	if i := strings.Index(project, ":"); i >= 0 {
+		return project[i+1:] + "." + project[:i]
+	}
+	return project
+}
+
+func lastPathSegment(url string) string {
+	return url[strings.LastIndex(url, "/")+1:]
+}
+
+// serviceMetadata returns the value of the metadata <prefix><name>, for the service name, or of the naked prefix,
+// for all the services of the instance, defaulting to def.
+func serviceMetadata(metadata map[string]string, prefix, name, def string) string {
+	if _, v, has := serviceMetadataKey(metadata, prefix, name); has {
+		return v
+	}
+	return def
+}
+
+// serviceMetadataKey returns the key and value of the metadata <prefix><name> or of the naked prefix, like
+// serviceMetadata does.
+func serviceMetadataKey(metadata map[string]string, prefix, name string) (string, string, bool) {
+	for _, key := range []string{strings.TrimRight(prefix+name, "_"), strings.TrimRight(prefix, "_")} {
+		if v, has := metadata[key]; has {
+			return key, v, true
+		}
+	}
+	return "", "", false
+}
+
+// addressMetadata returns the address family or mode of the service name set by the metadata, in any case, or def.
+// A value that isn't one of known is ignored, def is returned along with the key of the metadata.
+func addressMetadata(metadata map[string]string, prefix, name, def string, known ...string) (value, invalidKey string) {
+	key, v, has := serviceMetadataKey(metadata, prefix, name)
+	if !has {
+		return def, ""
+	}
+	v = strings.ToLower(strings.TrimSpace(v))
+	for _, k := range known {
+		if v == k {
+			return v, ""
+		}
+	}
+	return def, key
+}
+
+// targetInterface returns the network interface the targets of the service name are reached through. It is chosen
+// with the metadata prometheus_interface_<name> or prometheus_interface, either by name (nic1) or by index (1), and
+// defaults to the first interface.
+func targetInterface(ifaces []*compute.NetworkInterface, metadata map[string]string, name string) *compute.NetworkInterface {
+	value := serviceMetadata(metadata, gcePrefixInterface, name, "")
+	if value == "" {
+		return ifaces[0]
+	}
+
+	for _, iface := range ifaces {
+		if iface.Name == value {
+			return iface
+		}
+	}
+	if n, err := strconv.Atoi(value); err == nil && n >= 0 && n < len(ifaces) {
+		return ifaces[n]
+	}
+	return ifaces[0]
+}
+
+// parseParams returns the scrape parameters declared by the metadata prometheus_param_<name>_<param> of the services,
+// and prometheus_param_<param> for all the services under the empty name. The service of a parameter is the longest
+// service name prefixing it.
+func parseParams(metadata map[string]string, services []string) map[string]map[string]string {
+	params := make(map[string]map[string]string)
+	for key, v := range metadata {
+		if !strings.HasPrefix(key, gcePrefixParam) {
+			continue
+		}
+		param := key[len(gcePrefixParam):]
+		service := ""
+		for _, name := range services {
+			if name != "" && len(name) > len(service) && strings.HasPrefix(param, name+"_") && len(param) > len(name)+1 {
+				service = name
+			}
+		}
+		if service != "" {
+			param = param[len(service)+1:]
+		}
+		if param == "" {
+			continue
+		}
+		if _, ok := params[service]; !ok {
+			params[service] = make(map[string]string)
+		}
+		params[service][pstrutil.SanitizeLabelName(param)] = v
+	}
+	return params
 }
 
 func parsePorts(key, value, prefix string) (ports []int, name string, has bool) {
@@ -0,0 +1,75 @@
+package gcppromd
+
+import (
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+)
+
+func TestInstanceConfigsAddressMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		opts     DiscoveryOptions
+		target   string
+		invalid  string
+	}{
+		{name: "default", target: "10.0.0.2:9100"},
+		{name: "options", opts: DiscoveryOptions{AddressMode: AddressModePublic}, target: "203.0.113.2:9100"},
+		{name: "public", metadata: map[string]string{"prometheus_address_mode": "public"}, target: "203.0.113.2:9100"},
+		{name: "upper case", metadata: map[string]string{"prometheus_address_family": "IPv6"}, target: "[fd20::2]:9100"},
+		{name: "per service", metadata: map[string]string{"prometheus_address_family_node": " IPV6 "}, target: "[fd20::2]:9100"},
+		{name: "per service mode", metadata: map[string]string{"prometheus_address_mode_node": " Zonal-DNS "}, target: "vm-1.europe-west4-a.c.project-a.internal:9100"},
+		{
+			name:     "unknown family",
+			metadata: map[string]string{"prometheus_address_family": "ip6"},
+			target:   "10.0.0.2:9100",
+			invalid:  ",prometheus_address_family,",
+		},
+		{
+			name:     "unknown mode",
+			metadata: map[string]string{"prometheus_address_mode": "pubic"},
+			opts:     DiscoveryOptions{AddressFamily: AddressFamilyIPv6},
+			target:   "[fd20::2]:9100",
+			invalid:  ",prometheus_address_mode,",
+		},
+		{
+			name:     "unknown mode and family",
+			metadata: map[string]string{"prometheus_address_mode_node": "dns", "prometheus_address_family": "ip6"},
+			target:   "10.0.0.2:9100",
+			invalid:  ",prometheus_address_family,prometheus_address_mode_node,",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ports := "9100"
+			items := []*compute.MetadataItems{{Key: "prometheus_ports_node", Value: &ports}}
+			for key, value := range tt.metadata {
+				value := value
+				items = append(items, &compute.MetadataItems{Key: key, Value: &value})
+			}
+			inst := &compute.Instance{
+				Name: "vm-1",
+				Zone: "https://www.googleapis.com/compute/v1/projects/project-a/zones/europe-west4-a",
+				NetworkInterfaces: []*compute.NetworkInterface{{
+					Name:          "nic0",
+					NetworkIP:     "10.0.0.2",
+					Ipv6Address:   "fd20::2",
+					AccessConfigs: []*compute.AccessConfig{{Type: "ONE_TO_ONE_NAT", NatIP: "203.0.113.2"}},
+				}},
+				Metadata: &compute.Metadata{Items: items},
+			}
+
+			configs := instanceConfigs("project-a", inst, tt.opts, nil, map[string]*delagatedHost{})
+			if len(configs) != 1 || len(configs[0].Targets) != 1 {
+				t.Fatalf("instanceConfigs() = %+v, want a single target", configs)
+			}
+			if got := configs[0].Targets[0]; got != tt.target {
+				t.Errorf("target = %s, want %s", got, tt.target)
+			}
+			if got := string(configs[0].Labels[promLabelInvalidMetadata]); got != tt.invalid {
+				t.Errorf("%s = %q, want %q", promLabelInvalidMetadata, got, tt.invalid)
+			}
+		})
+	}
+}
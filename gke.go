@@ -0,0 +1,185 @@
+package gcppromd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/container/v1"
+
+	pmodel "github.com/prometheus/common/model"
+	pstrutil "github.com/prometheus/prometheus/util/strutil"
+)
+
+const (
+	// Label names generated for the GKE nodes
+	promLabelGKE               = pmodel.MetaLabelPrefix + "gke_"
+	promLabelGKEProject        = promLabelGKE + "project"
+	promLabelGKECluster        = promLabelGKE + "cluster"
+	promLabelGKENodePool       = promLabelGKE + "node_pool"
+	promLabelGKELocation       = promLabelGKE + "location"
+	promLabelGKEZone           = promLabelGKE + "zone"
+	promLabelGKEClusterVersion = promLabelGKE + "cluster_version"
+	promLabelGKENodeVersion    = promLabelGKE + "node_version"
+	promLabelGKENodeName       = promLabelGKE + "node_name"
+	promLabelGKEPrivateIP      = promLabelGKE + "private_ip"
+	promLabelGKEPortName       = promLabelGKE + "port_name"
+	promLabelGKELabel          = promLabelGKE + "label_"
+	// GCE labels set by GKE on its nodes
+	gkeLabelCluster  = "goog-k8s-cluster-name"
+	gkeLabelLocation = "goog-k8s-cluster-location"
+	gkeLabelNodePool = "goog-k8s-node-pool-name"
+)
+
+// DefaultGKEPorts are the ports of the GKE nodes scraped when none are configured.
+var DefaultGKEPorts = map[string]int{
+	"kubelet":       10250,
+	"node-exporter": 9100,
+}
+
+// GKEDiscovery discovers the nodes of the GKE clusters.
+type GKEDiscovery struct {
+	container *container.Service
+	compute   *compute.Service
+}
+
+// NewGKEDiscovery creates a new GKE discovery.
+func NewGKEDiscovery() (*GKEDiscovery, error) {
+	ctx := context.Background()
+	cl, err := newClient(ctx, container.CloudPlatformScope)
+	if err != nil {
+		return nil, err
+	}
+
+	containerService, err := container.New(cl)
+	if err != nil {
+		return nil, err
+	}
+	computeService, err := compute.New(cl)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GKEDiscovery{container: containerService, compute: computeService}, nil
+}
+
+// gkeNodePool is a node pool and the cluster it belongs to.
+type gkeNodePool struct {
+	cluster *container.Cluster
+	pool    *container.NodePool
+}
+
+// Nodes returns a target per port of opts.GKEPorts for every node of the GKE clusters of a project. The presence
+// label is not required on the nodes, filter can further restrict the nodes.
+func (d *GKEDiscovery) Nodes(ctx context.Context, project, filter string, opts DiscoveryOptions) ([]*PromConfig, error) {
+	clusters, err := d.container.Projects.Locations.Clusters.
+		List(fmt.Sprintf("projects/%s/locations/-", project)).
+		Fields("clusters(name,location,currentMasterVersion,resourceLabels,nodePools(name,version,instanceGroupUrls))").
+		Context(ctx).
+		Do()
+	if err != nil {
+		return nil, err
+	}
+	if len(clusters.Clusters) == 0 {
+		return nil, nil
+	}
+
+	// node pools by instance group manager key and by cluster location and names
+	pools := make(map[string]*gkeNodePool)
+	for _, cluster := range clusters.Clusters {
+		for _, pool := range cluster.NodePools {
+			np := &gkeNodePool{cluster: cluster, pool: pool}
+			for _, url := range pool.InstanceGroupUrls {
+				pools[migKey(url)] = np
+			}
+			pools[cluster.Location+"/"+cluster.Name+"/"+pool.Name] = np
+		}
+	}
+
+	ialReq := d.compute.Instances.
+		AggregatedList(project).
+		Filter(combineFilters(labelExistsFilter(gkeLabelCluster, isRegexpFilter(filter)), filter)).
+		Fields("nextPageToken", "items/*/instances(name,zone,labels,networkInterfaces,metadata)")
+
+	configs := make([]*PromConfig, 0, 100)
+	err = ialReq.Pages(ctx, func(ial *compute.InstanceAggregatedList) error {
+		for _, zone := range ial.Items {
+			for _, inst := range zone.Instances {
+				np := nodePool(pools, inst)
+				if np == nil {
+					continue
+				}
+				configs = append(configs, nodeConfigs(project, inst, np, opts)...)
+			}
+		}
+		return nil
+	})
+
+	return configs, err
+}
+
+// nodePool returns the node pool of a node, from the instance group manager that created it or from the labels
+// set by GKE.
+func nodePool(pools map[string]*gkeNodePool, inst *compute.Instance) *gkeNodePool {
+	if inst.Metadata != nil {
+		for _, item := range inst.Metadata.Items {
+			if item.Key == gceMetadataCreatedBy && item.Value != nil {
+				if np, ok := pools[migKey(*item.Value)]; ok {
+					return np
+				}
+			}
+		}
+	}
+	return pools[inst.Labels[gkeLabelLocation]+"/"+inst.Labels[gkeLabelCluster]+"/"+inst.Labels[gkeLabelNodePool]]
+}
+
+// nodeConfigs returns the targets of a GKE node.
+func nodeConfigs(project string, inst *compute.Instance, np *gkeNodePool, opts DiscoveryOptions) []*PromConfig {
+	if len(inst.NetworkInterfaces) == 0 {
+		return nil
+	}
+	iface := inst.NetworkInterfaces[0]
+	host := targetHost(project, inst, iface, opts.addressMode(), opts.addressFamily())
+	if host == "" {
+		return nil
+	}
+
+	labels := pmodel.LabelSet{
+		promLabelGKEProject:        pmodel.LabelValue(project),
+		promLabelGKECluster:        pmodel.LabelValue(np.cluster.Name),
+		promLabelGKENodePool:       pmodel.LabelValue(np.pool.Name),
+		promLabelGKELocation:       pmodel.LabelValue(np.cluster.Location),
+		promLabelGKEZone:           pmodel.LabelValue(lastPathSegment(inst.Zone)),
+		promLabelGKEClusterVersion: pmodel.LabelValue(np.cluster.CurrentMasterVersion),
+		promLabelGKENodeVersion:    pmodel.LabelValue(np.pool.Version),
+		promLabelGKENodeName:       pmodel.LabelValue(inst.Name),
+		promLabelGKEPrivateIP:      pmodel.LabelValue(iface.NetworkIP),
+	}
+	for key, value := range np.cluster.ResourceLabels {
+		labels[pmodel.LabelName(promLabelGKELabel+pstrutil.SanitizeLabelName(key))] = pmodel.LabelValue(value)
+	}
+
+	ports := opts.GKEPorts
+	if len(ports) == 0 {
+		ports = DefaultGKEPorts
+	}
+	names := make([]string, 0, len(ports))
+	for name := range ports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	configs := make([]*PromConfig, 0, len(names))
+	for _, name := range names {
+		portLabels := labels.Clone()
+		portLabels[promLabelGKEPortName] = pmodel.LabelValue(name)
+		configs = append(configs, &PromConfig{
+			Targets: []string{net.JoinHostPort(host, strconv.Itoa(ports[name]))},
+			Labels:  portLabels,
+		})
+	}
+	return configs
+}
@@ -0,0 +1,305 @@
+package gcppromd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	pmodel "github.com/prometheus/common/model"
+	pstrutil "github.com/prometheus/prometheus/util/strutil"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// Label names generated for the forwarding rules
+	promLabelLB               = promLabel + "lb_"
+	promLabelLBName           = promLabelLB + "name"
+	promLabelLBRegion         = promLabelLB + "region"
+	promLabelLBIP             = promLabelLB + "ip"
+	promLabelLBIPProtocol     = promLabelLB + "ip_protocol"
+	promLabelLBScheme         = promLabelLB + "scheme"
+	promLabelLBTarget         = promLabelLB + "target"
+	promLabelLBBackendService = promLabelLB + "backend_service"
+	promLabelLBBackendGroups  = promLabelLB + "backend_groups"
+	promLabelLBLabel          = promLabelLB + "label_"
+	// label of a forwarding rule overriding the port of its targets
+	gceLabelPort = gcePrefix + "port"
+)
+
+// ForwardingRules returns the targets of the regional and global forwarding rules of a project carrying the presence
+// label. The port of the targets is the prometheus_port label of the rule, or the ports it forwards. The backend
+// service of a rule is resolved through its target proxy and URL map, and the instance groups backing it are
+// emitted so that the targets can be related to the instances behind the load balancer.
+func (d *GCEDiscovery) ForwardingRules(ctx context.Context, project string, opts DiscoveryOptions) ([]*PromConfig, error) {
+	filter := opts.presenceFilter(true)
+	fields := googleapi.Field("name,IPAddress,IPProtocol,loadBalancingScheme,ports,portRange,target,backendService,region,labels")
+
+	rules := make([]*compute.ForwardingRule, 0, 10)
+	aggReq := d.service.ForwardingRules.AggregatedList(project).Fields("nextPageToken", "items/*/forwardingRules("+fields+")")
+	globalReq := d.service.GlobalForwardingRules.List(project).Fields("nextPageToken", "items("+fields+")")
+	if filter != "" {
+		aggReq = aggReq.Filter(filter)
+		globalReq = globalReq.Filter(filter)
+	}
+	err := aggReq.Pages(ctx, func(l *compute.ForwardingRuleAggregatedList) error {
+		for _, scope := range l.Items {
+			rules = append(rules, scope.ForwardingRules...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = globalReq.Pages(ctx, func(l *compute.ForwardingRuleList) error {
+		rules = append(rules, l.Items...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resolver := &lbResolver{client: d.client, service: d.service, backendServices: make(map[string]string), groups: make(map[string][]string)}
+	configs := make([]*PromConfig, 0, len(rules))
+	for _, rule := range rules {
+		ports := forwardingRulePorts(rule)
+		if len(ports) == 0 || rule.IPAddress == "" {
+			continue
+		}
+
+		labels := pmodel.LabelSet{
+			promLabelProject:      pmodel.LabelValue(project),
+			promLabelLBName:       pmodel.LabelValue(rule.Name),
+			promLabelLBRegion:     pmodel.LabelValue(lastPathSegment(rule.Region)),
+			promLabelLBIP:         pmodel.LabelValue(rule.IPAddress),
+			promLabelLBIPProtocol: pmodel.LabelValue(rule.IPProtocol),
+			promLabelLBScheme:     pmodel.LabelValue(rule.LoadBalancingScheme),
+			promLabelLBTarget:     pmodel.LabelValue(rule.Target),
+		}
+		for key, value := range rule.Labels {
+			labels[pmodel.LabelName(promLabelLBLabel+pstrutil.SanitizeLabelName(key))] = pmodel.LabelValue(value)
+		}
+
+		backendService := rule.BackendService
+		if backendService == "" && rule.Target != "" {
+			if backendService, err = resolver.backendService(ctx, rule.Target); err != nil {
+				return nil, err
+			}
+		}
+		if backendService != "" {
+			groups, err := resolver.backendGroups(ctx, backendService)
+			if err != nil {
+				return nil, err
+			}
+			labels[promLabelLBBackendService] = pmodel.LabelValue(backendService)
+			if len(groups) > 0 {
+				labels[promLabelLBBackendGroups] = pmodel.LabelValue(promSeparator + strings.Join(groups, promSeparator) + promSeparator)
+			}
+		}
+
+		for _, port := range ports {
+			configs = append(configs, &PromConfig{
+				Targets: []string{net.JoinHostPort(rule.IPAddress, strconv.Itoa(port))},
+				Labels:  labels,
+			})
+		}
+	}
+
+	return configs, nil
+}
+
+// forwardingRulePorts returns the ports of the targets of a forwarding rule: its prometheus_port label, its ports or
+// the first port of its port range.
+func forwardingRulePorts(rule *compute.ForwardingRule) []int {
+	if value, ok := rule.Labels[gceLabelPort]; ok {
+		if port, err := strconv.Atoi(value); err == nil {
+			return []int{port}
+		}
+		return nil
+	}
+	raw := rule.Ports
+	if len(raw) == 0 && rule.PortRange != "" {
+		raw = []string{strings.SplitN(rule.PortRange, "-", 2)[0]}
+	}
+	ports := make([]int, 0, len(raw))
+	for _, value := range raw {
+		if port, err := strconv.Atoi(value); err == nil {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// lbResolver resolves the backend services of the forwarding rules and their instance groups, it remembers the
+// resources it looked up so that each is fetched once per discovery.
+type lbResolver struct {
+	client          *http.Client
+	service         *compute.Service
+	backendServices map[string]string
+	groups          map[string][]string
+}
+
+// resourcePath splits the URL of a compute resource in its project, region, empty for a global resource, collection
+// and name.
+func resourcePath(url string) (project, region, collection, name string, err error) {
+	i := strings.Index(url, "projects/")
+	if i < 0 {
+		return "", "", "", "", fmt.Errorf("invalid resource URL %s", url)
+	}
+	segments := strings.Split(url[i+len("projects/"):], "/")
+	switch {
+	case len(segments) == 4 && segments[1] == "global":
+		return segments[0], "", segments[2], segments[3], nil
+	case len(segments) == 5 && segments[1] == "regions":
+		return segments[0], segments[2], segments[3], segments[4], nil
+	}
+	return "", "", "", "", fmt.Errorf("invalid resource URL %s", url)
+}
+
+// backendService returns the URL of the backend service a target proxy or URL map routes to by default, an empty
+// string when the target has no backend service, e.g. a target pool or a zonal target instance.
+func (r *lbResolver) backendService(ctx context.Context, target string) (string, error) {
+	if service, ok := r.backendServices[target]; ok {
+		return service, nil
+	}
+
+	project, region, collection, name, err := resourcePath(target)
+	if err != nil {
+		// a zonal target, like a target instance, has no backend service
+		r.backendServices[target] = ""
+		return "", nil
+	}
+	next := ""
+	switch collection {
+	case "targetHttpProxies":
+		var proxy *compute.TargetHttpProxy
+		if region == "" {
+			proxy, err = r.service.TargetHttpProxies.Get(project, name).Context(ctx).Do()
+		} else {
+			proxy, err = r.service.RegionTargetHttpProxies.Get(project, region, name).Context(ctx).Do()
+		}
+		if err == nil {
+			next = proxy.UrlMap
+		}
+	case "targetHttpsProxies":
+		var proxy *compute.TargetHttpsProxy
+		if region == "" {
+			proxy, err = r.service.TargetHttpsProxies.Get(project, name).Context(ctx).Do()
+		} else {
+			proxy, err = r.service.RegionTargetHttpsProxies.Get(project, region, name).Context(ctx).Do()
+		}
+		if err == nil {
+			next = proxy.UrlMap
+		}
+	case "targetTcpProxies":
+		proxy := &compute.TargetTcpProxy{}
+		if region == "" {
+			proxy, err = r.service.TargetTcpProxies.Get(project, name).Context(ctx).Do()
+		} else {
+			err = r.getRegional(ctx, project, region, collection, name, proxy)
+		}
+		if err == nil {
+			next = proxy.Service
+		}
+	case "targetSslProxies":
+		proxy := &compute.TargetSslProxy{}
+		if region == "" {
+			proxy, err = r.service.TargetSslProxies.Get(project, name).Context(ctx).Do()
+		} else {
+			err = r.getRegional(ctx, project, region, collection, name, proxy)
+		}
+		if err == nil {
+			next = proxy.Service
+		}
+	case "urlMaps":
+		var urlMap *compute.UrlMap
+		if region == "" {
+			urlMap, err = r.service.UrlMaps.Get(project, name).Context(ctx).Do()
+		} else {
+			urlMap, err = r.service.RegionUrlMaps.Get(project, region, name).Context(ctx).Do()
+		}
+		if err == nil {
+			next = urlMap.DefaultService
+		}
+	case "backendServices":
+		r.backendServices[target] = target
+		return target, nil
+	}
+	if isNotFound(err) {
+		// deleted since the forwarding rules were listed
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	service := ""
+	if next != "" {
+		if service, err = r.backendService(ctx, next); err != nil {
+			return "", err
+		}
+	}
+	r.backendServices[target] = service
+	return service, nil
+}
+
+// getRegional gets a regional resource the compute client has no service for, like the regional TCP and SSL proxies.
+func (r *lbResolver) getRegional(ctx context.Context, project, region, collection, name string, resource interface{}) error {
+	path := strings.Join([]string{"projects", project, "regions", region, collection, name}, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.service.BasePath+path, nil)
+	if err != nil {
+		return err
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err := googleapi.CheckResponse(res); err != nil {
+		return err
+	}
+	return json.NewDecoder(res.Body).Decode(resource)
+}
+
+// backendGroups returns the sorted URLs of the instance groups and network endpoint groups of a backend service.
+func (r *lbResolver) backendGroups(ctx context.Context, backendService string) ([]string, error) {
+	if groups, ok := r.groups[backendService]; ok {
+		return groups, nil
+	}
+
+	project, region, _, name, err := resourcePath(backendService)
+	if err != nil {
+		return nil, err
+	}
+	var service *compute.BackendService
+	if region == "" {
+		service, err = r.service.BackendServices.Get(project, name).Fields("backends(group)").Context(ctx).Do()
+	} else {
+		service, err = r.service.RegionBackendServices.Get(project, region, name).Fields("backends(group)").Context(ctx).Do()
+	}
+	if isNotFound(err) {
+		r.groups[backendService] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]string, 0, len(service.Backends))
+	for _, backend := range service.Backends {
+		groups = append(groups, backend.Group)
+	}
+	sort.Strings(groups)
+	r.groups[backendService] = groups
+	return groups, nil
+}
+
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	return ok && apiErr.Code == http.StatusNotFound
+}
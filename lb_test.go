@@ -0,0 +1,71 @@
+package gcppromd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+const computePrefix = "https://www.googleapis.com/compute/v1/projects/project-a/"
+
+func TestForwardingRulesBackendServices(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/projects/project-a/aggregated/forwardingRules":
+			fmt.Fprintf(w, `{"items": {"regions/europe-west4": {"forwardingRules": [
+				{"name": "instance", "IPAddress": "10.0.0.1", "ports": ["9100"], "target": "%[1]szones/europe-west4-a/targetInstances/ti"},
+				{"name": "grpc", "IPAddress": "10.0.0.2", "ports": ["9100"], "target": "%[1]sregions/europe-west4/targetGrpcProxies/grpc"},
+				{"name": "tcp", "IPAddress": "10.0.0.3", "ports": ["9100"], "target": "%[1]sregions/europe-west4/targetTcpProxies/tcp"},
+				{"name": "pool", "IPAddress": "10.0.0.4", "ports": ["9100"], "target": "%[1]sregions/europe-west4/targetPools/pool"}
+			]}}}`, computePrefix)
+		case "/projects/project-a/global/forwardingRules":
+			fmt.Fprintf(w, `{"items": [
+				{"name": "global-tcp", "IPAddress": "10.0.1.3", "ports": ["9100"], "target": "%[1]sglobal/targetTcpProxies/tcp"}
+			]}`, computePrefix)
+		case "/projects/project-a/regions/europe-west4/targetTcpProxies/tcp":
+			fmt.Fprintf(w, `{"name": "tcp", "service": "%sregions/europe-west4/backendServices/regional"}`, computePrefix)
+		case "/projects/project-a/global/targetTcpProxies/tcp":
+			fmt.Fprintf(w, `{"name": "tcp", "service": "%sglobal/backendServices/global"}`, computePrefix)
+		case "/projects/project-a/regions/europe-west4/backendServices/regional":
+			fmt.Fprintf(w, `{"backends": [{"group": "%szones/europe-west4-a/instanceGroups/regional"}]}`, computePrefix)
+		case "/projects/project-a/global/backendServices/global":
+			fmt.Fprintf(w, `{"backends": [{"group": "%szones/europe-west4-a/instanceGroups/global"}]}`, computePrefix)
+		default:
+			http.Error(w, `{"error": {"code": 404, "message": "not found"}}`, http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	service, err := compute.NewService(context.Background(), option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &GCEDiscovery{client: srv.Client(), service: service}
+	configs, err := d.ForwardingRules(context.Background(), "project-a", DiscoveryOptions{DisablePresenceFilter: true})
+	if err != nil {
+		t.Fatalf("ForwardingRules() = %v", err)
+	}
+
+	want := map[string][2]string{
+		"instance":   {"", ""},
+		"grpc":       {"", ""},
+		"pool":       {"", ""},
+		"tcp":        {computePrefix + "regions/europe-west4/backendServices/regional", "," + computePrefix + "zones/europe-west4-a/instanceGroups/regional,"},
+		"global-tcp": {computePrefix + "global/backendServices/global", "," + computePrefix + "zones/europe-west4-a/instanceGroups/global,"},
+	}
+	if len(configs) != len(want) {
+		t.Fatalf("ForwardingRules() returned %d targets, want %d", len(configs), len(want))
+	}
+	for _, config := range configs {
+		name := string(config.Labels[promLabelLBName])
+		got := [2]string{string(config.Labels[promLabelLBBackendService]), string(config.Labels[promLabelLBBackendGroups])}
+		if got != want[name] {
+			t.Errorf("%s: backend service and groups = %q, want %q", name, got, want[name])
+		}
+	}
+}
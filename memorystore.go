@@ -0,0 +1,140 @@
+package gcppromd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"text/template"
+
+	pmodel "github.com/prometheus/common/model"
+	pstrutil "github.com/prometheus/prometheus/util/strutil"
+	"google.golang.org/api/redis/v1"
+)
+
+const (
+	// Label names generated for the Memorystore instances
+	promLabelRedis             = pmodel.MetaLabelPrefix + "memorystore_"
+	promLabelRedisProject      = promLabelRedis + "project"
+	promLabelRedisName         = promLabelRedis + "name"
+	promLabelRedisDisplayName  = promLabelRedis + "display_name"
+	promLabelRedisTier         = promLabelRedis + "tier"
+	promLabelRedisMemorySize   = promLabelRedis + "memory_size_gb"
+	promLabelRedisRegion       = promLabelRedis + "region"
+	promLabelRedisZone         = promLabelRedis + "zone"
+	promLabelRedisVersion      = promLabelRedis + "redis_version"
+	promLabelRedisState        = promLabelRedis + "state"
+	promLabelRedisHost         = promLabelRedis + "host"
+	promLabelRedisPort         = promLabelRedis + "port"
+	promLabelRedisReadEndpoint = promLabelRedis + "read_endpoint"
+	promLabelRedisLabel        = promLabelRedis + "label_"
+)
+
+// MemorystoreInstance is the data the Memorystore exporter address template is executed with.
+type MemorystoreInstance struct {
+	Project string
+	Name    string
+	Region  string
+	Zone    string
+	Host    string
+	Port    int64
+}
+
+// MemorystoreDiscovery discovers the Memorystore for Redis instances.
+type MemorystoreDiscovery struct {
+	service *redis.Service
+}
+
+// NewMemorystoreDiscovery creates a new Memorystore discovery.
+func NewMemorystoreDiscovery() (*MemorystoreDiscovery, error) {
+	ctx := context.Background()
+	cl, err := newClient(ctx, redis.CloudPlatformScope)
+	if err != nil {
+		return nil, err
+	}
+
+	service, err := redis.New(cl)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MemorystoreDiscovery{service: service}, nil
+}
+
+// Instances returns a target per Memorystore instance of a project, in every region. The targets are the address of
+// the exporter given by opts.MemorystoreExporter, with redis://<host>:<port> as the target URL parameter.
+func (d *MemorystoreDiscovery) Instances(ctx context.Context, project string, opts DiscoveryOptions) ([]*PromConfig, error) {
+	exporter, err := parseExporterAddress("Memorystore", opts.MemorystoreExporter, MemorystoreInstance{})
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make([]*PromConfig, 0, 10)
+	var unreachable []string
+	err = d.service.Projects.Locations.Instances.
+		List(fmt.Sprintf("projects/%s/locations/-", project)).
+		Pages(ctx, func(l *redis.ListInstancesResponse) error {
+			unreachable = append(unreachable, l.Unreachable...)
+			for _, inst := range l.Instances {
+				config, err := memorystoreConfig(project, inst, exporter)
+				if err != nil {
+					return err
+				}
+				configs = append(configs, config)
+			}
+			return nil
+		})
+	if err == nil && len(unreachable) > 0 {
+		// the instances of those locations are unknown, the discovery is incomplete
+		err = fmt.Errorf("unreachable locations: %s", strings.Join(unreachable, ", "))
+	}
+	return configs, err
+}
+
+// memorystoreConfig returns the target of a Memorystore instance.
+func memorystoreConfig(project string, inst *redis.Instance, exporter *template.Template) (*PromConfig, error) {
+	// the name of an instance is projects/<project>/locations/<region>/instances/<name>
+	segments := strings.Split(inst.Name, "/")
+	region := ""
+	if len(segments) == 6 {
+		region = segments[3]
+	}
+	data := MemorystoreInstance{
+		Project: project,
+		Name:    lastPathSegment(inst.Name),
+		Region:  region,
+		Zone:    inst.CurrentLocationId,
+		Host:    inst.Host,
+		Port:    inst.Port,
+	}
+
+	addr, err := executeExporterAddress(exporter, data)
+	if err != nil {
+		return nil, fmt.Errorf("instance %s: %v", data.Name, err)
+	}
+
+	port := strconv.FormatInt(inst.Port, 10)
+	labels := pmodel.LabelSet{
+		promLabelRedisProject:              pmodel.LabelValue(project),
+		promLabelRedisName:                 pmodel.LabelValue(data.Name),
+		promLabelRedisDisplayName:          pmodel.LabelValue(inst.DisplayName),
+		promLabelRedisTier:                 pmodel.LabelValue(inst.Tier),
+		promLabelRedisMemorySize:           pmodel.LabelValue(strconv.FormatInt(inst.MemorySizeGb, 10)),
+		promLabelRedisRegion:               pmodel.LabelValue(region),
+		promLabelRedisZone:                 pmodel.LabelValue(inst.CurrentLocationId),
+		promLabelRedisVersion:              pmodel.LabelValue(inst.RedisVersion),
+		promLabelRedisState:                pmodel.LabelValue(inst.State),
+		promLabelRedisHost:                 pmodel.LabelValue(inst.Host),
+		promLabelRedisPort:                 pmodel.LabelValue(port),
+		pmodel.ParamLabelPrefix + "target": pmodel.LabelValue("redis://" + net.JoinHostPort(inst.Host, port)),
+	}
+	if inst.ReadEndpoint != "" {
+		labels[promLabelRedisReadEndpoint] = pmodel.LabelValue(net.JoinHostPort(inst.ReadEndpoint, strconv.FormatInt(inst.ReadEndpointPort, 10)))
+	}
+	for key, value := range inst.Labels {
+		labels[pmodel.LabelName(promLabelRedisLabel+pstrutil.SanitizeLabelName(key))] = pmodel.LabelValue(value)
+	}
+
+	return &PromConfig{Targets: []string{addr}, Labels: labels}, nil
+}
@@ -0,0 +1,64 @@
+package gcppromd
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "gcppromd"
+
+var (
+	discoveryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "discovery_duration_seconds",
+		Help:      "Duration of the targets discovery of a project.",
+		Buckets:   []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"project", "source"})
+	discoveryErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "discovery_errors_total",
+		Help:      "Number of failed targets discoveries of a project.",
+	}, []string{"project", "source"})
+	discoveryTargets = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "discovery_targets",
+		Help:      "Number of targets emitted by the last successful discovery of a project.",
+	}, []string{"project", "source"})
+	discoveryProjects = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "discovery_projects",
+		Help:      "Number of projects found by the last projects auto-discovery.",
+	})
+	feedEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "feed_events_total",
+		Help:      "Number of messages received from the Cloud Asset Inventory feeds by kind: update, delete, ignored or invalid.",
+	}, []string{"kind"})
+	apiRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gcp_api_requests_total",
+		Help:      "Number of requests sent to the Google Cloud APIs.",
+	}, []string{"api"})
+	apiErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gcp_api_errors_total",
+		Help:      "Number of requests to the Google Cloud APIs that failed or were answered with an error status.",
+	}, []string{"api"})
+)
+
+// instrumentedTransport counts the requests going through an http.RoundTripper and their errors.
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	api := req.URL.Host
+	apiRequests.WithLabelValues(api).Inc()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode >= http.StatusBadRequest {
+		apiErrors.WithLabelValues(api).Inc()
+	}
+	return resp, err
+}
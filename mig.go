@@ -0,0 +1,152 @@
+package gcppromd
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	promLabelInstanceGroup     = promLabel + "instance_group"
+	promLabelInstanceTemplate  = promLabel + "instance_template"
+	promLabelAutoscaler        = promLabel + "autoscaler"
+	promLabelAutoscalerMode    = promLabel + "autoscaler_mode"
+	promLabelAutoscalerMinSize = promLabel + "autoscaler_min_replicas"
+	promLabelAutoscalerMaxSize = promLabel + "autoscaler_max_replicas"
+	// metadata set by GCE on the instances of a managed instance group
+	gceMetadataCreatedBy        = "created-by"
+	gceMetadataInstanceTemplate = "instance-template"
+	// how long the managed instance groups of a project are cached
+	migCacheTTL = 10 * time.Minute
+)
+
+// migInfo describes a managed instance group.
+type migInfo struct {
+	name             string
+	instanceTemplate string
+	autoscaler       *compute.Autoscaler
+}
+
+type migCacheEntry struct {
+	migs    map[string]*migInfo
+	updated time.Time
+}
+
+// migCache caches the managed instance groups of the projects, so that they are looked up once per migCacheTTL.
+type migCache struct {
+	mu      sync.Mutex
+	entries map[string]*migCacheEntry
+}
+
+// migKey returns the location and name of an instance group manager, e.g. zones/<zone>/instanceGroupManagers/<name>,
+// from any of its URLs or the created-by metadata of its instances.
+func migKey(url string) string {
+	for _, scope := range []string{"/zones/", "/regions/"} {
+		if i := strings.LastIndex(url, scope); i >= 0 {
+			return url[i+1:]
+		}
+	}
+	return url
+}
+
+// managedInstanceGroups returns the managed instance groups of a project by key. The groups are listed about once
+// per migCacheTTL, when they can't be listed no group is returned until the next attempt.
+func (d *GCEDiscovery) managedInstanceGroups(ctx context.Context, project string) map[string]*migInfo {
+	d.migs.mu.Lock()
+	entry, ok := d.migs.entries[project]
+	d.migs.mu.Unlock()
+	if ok && time.Since(entry.updated) < migCacheTTL {
+		return entry.migs
+	}
+
+	migs := make(map[string]*migInfo)
+	err := d.service.InstanceGroupManagers.
+		AggregatedList(project).
+		Fields("nextPageToken", "items/*/instanceGroupManagers(name,selfLink,instanceTemplate)").
+		Pages(ctx, func(l *compute.InstanceGroupManagerAggregatedList) error {
+			for _, scope := range l.Items {
+				for _, igm := range scope.InstanceGroupManagers {
+					migs[migKey(igm.SelfLink)] = &migInfo{
+						name:             igm.Name,
+						instanceTemplate: lastPathSegment(igm.InstanceTemplate),
+					}
+				}
+			}
+			return nil
+		})
+	if err == nil {
+		err = d.service.Autoscalers.
+			AggregatedList(project).
+			Fields("nextPageToken", "items/*/autoscalers(name,target,autoscalingPolicy(mode,minNumReplicas,maxNumReplicas))").
+			Pages(ctx, func(l *compute.AutoscalerAggregatedList) error {
+				for _, scope := range l.Items {
+					for _, as := range scope.Autoscalers {
+						if mig, ok := migs[migKey(as.Target)]; ok {
+							mig.autoscaler = as
+						}
+					}
+				}
+				return nil
+			})
+	}
+	if err != nil {
+		// the failed requests are accounted by the API metrics, the groups labels are only informative.
+		migs = map[string]*migInfo{}
+	}
+
+	d.migs.mu.Lock()
+	if d.migs.entries == nil {
+		d.migs.entries = make(map[string]*migCacheEntry)
+	}
+	d.migs.entries[project] = &migCacheEntry{migs: migs, updated: time.Now()}
+	d.migs.mu.Unlock()
+	return migs
+}
+
+// migLabels adds the labels of the managed instance group of an instance, identified by its metadata.
+func migLabels(labels pmodel.LabelSet, metadata map[string]string, migs map[string]*migInfo) {
+	createdBy, ok := metadata[gceMetadataCreatedBy]
+	if !ok || !strings.Contains(createdBy, "/instanceGroupManagers/") {
+		return
+	}
+	labels[promLabelInstanceGroup] = pmodel.LabelValue(lastPathSegment(createdBy))
+	if template, ok := metadata[gceMetadataInstanceTemplate]; ok {
+		labels[promLabelInstanceTemplate] = pmodel.LabelValue(lastPathSegment(template))
+	}
+
+	mig, ok := migs[migKey(createdBy)]
+	if !ok {
+		return
+	}
+	if _, ok := labels[promLabelInstanceTemplate]; !ok && mig.instanceTemplate != "" {
+		labels[promLabelInstanceTemplate] = pmodel.LabelValue(mig.instanceTemplate)
+	}
+	if as := mig.autoscaler; as != nil {
+		labels[promLabelAutoscaler] = pmodel.LabelValue(as.Name)
+		if policy := as.AutoscalingPolicy; policy != nil {
+			labels[promLabelAutoscalerMode] = pmodel.LabelValue(policy.Mode)
+			labels[promLabelAutoscalerMinSize] = pmodel.LabelValue(strconv.FormatInt(policy.MinNumReplicas, 10))
+			labels[promLabelAutoscalerMaxSize] = pmodel.LabelValue(strconv.FormatInt(policy.MaxNumReplicas, 10))
+		}
+	}
+}
+
+// hasMIGInstance tells if any of the instances belongs to a managed instance group.
+func hasMIGInstance(instances []*compute.Instance) bool {
+	for _, inst := range instances {
+		if inst.Metadata == nil {
+			continue
+		}
+		for _, i := range inst.Metadata.Items {
+			if i.Key == gceMetadataCreatedBy {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package gcppromd
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	pmodel "github.com/prometheus/common/model"
+	pstrutil "github.com/prometheus/prometheus/util/strutil"
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	// Label names generated for the network endpoints
+	promLabelNEG           = promLabel + "neg_"
+	promLabelNEGName       = promLabelNEG + "name"
+	promLabelNEGZone       = promLabelNEG + "zone"
+	promLabelNEGNetwork    = promLabelNEG + "network"
+	promLabelNEGSubnetwork = promLabelNEG + "subnetwork"
+	promLabelNEGType       = promLabelNEG + "type"
+	promLabelNEGInstance   = promLabelNEG + "instance"
+	promLabelNEGIP         = promLabelNEG + "ip"
+	promLabelNEGPort       = promLabelNEG + "port"
+	promLabelNEGAnnotation = promLabelNEG + "annotation_"
+)
+
+// NetworkEndpoints returns a target per endpoint of the zonal network endpoint groups of a project whose annotations
+// carry the presence label. The endpoints without a port use the default port of their group, the groups of
+// endpoints without any port are skipped.
+func (d *GCEDiscovery) NetworkEndpoints(ctx context.Context, project string, opts DiscoveryOptions) ([]*PromConfig, error) {
+	negs := make([]*compute.NetworkEndpointGroup, 0, 10)
+	err := d.service.NetworkEndpointGroups.AggregatedList(project).
+		Fields("nextPageToken", "items/*/networkEndpointGroups(name,zone,network,subnetwork,networkEndpointType,defaultPort,annotations)").
+		Pages(ctx, func(l *compute.NetworkEndpointGroupAggregatedList) error {
+			for _, scope := range l.Items {
+				for _, neg := range scope.NetworkEndpointGroups {
+					// the annotations can't be filtered by the API
+					if neg.Zone != "" && opts.matchesPresence(neg.Annotations) {
+						negs = append(negs, neg)
+					}
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make([]*PromConfig, 0, 10)
+	for _, neg := range negs {
+		labels := pmodel.LabelSet{
+			promLabelProject:       pmodel.LabelValue(project),
+			promLabelNEGName:       pmodel.LabelValue(neg.Name),
+			promLabelNEGZone:       pmodel.LabelValue(lastPathSegment(neg.Zone)),
+			promLabelNEGNetwork:    pmodel.LabelValue(neg.Network),
+			promLabelNEGSubnetwork: pmodel.LabelValue(neg.Subnetwork),
+			promLabelNEGType:       pmodel.LabelValue(neg.NetworkEndpointType),
+		}
+		for key, value := range neg.Annotations {
+			labels[pmodel.LabelName(promLabelNEGAnnotation+pstrutil.SanitizeLabelName(key))] = pmodel.LabelValue(value)
+		}
+
+		err := d.service.NetworkEndpointGroups.
+			ListNetworkEndpoints(project, lastPathSegment(neg.Zone), neg.Name, &compute.NetworkEndpointGroupsListEndpointsRequest{}).
+			Fields("nextPageToken", "items/networkEndpoint").
+			Pages(ctx, func(l *compute.NetworkEndpointGroupsListNetworkEndpoints) error {
+				for _, item := range l.Items {
+					if config := networkEndpointConfig(item.NetworkEndpoint, neg, labels); config != nil {
+						configs = append(configs, config)
+					}
+				}
+				return nil
+			})
+		if isNotFound(err) {
+			// deleted since the groups were listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return configs, nil
+}
+
+// networkEndpointConfig returns the target of an endpoint, nil when it has no IP address or port.
+func networkEndpointConfig(endpoint *compute.NetworkEndpoint, neg *compute.NetworkEndpointGroup, negLabels pmodel.LabelSet) *PromConfig {
+	if endpoint == nil || endpoint.IpAddress == "" {
+		return nil
+	}
+	port := endpoint.Port
+	if port == 0 {
+		port = neg.DefaultPort
+	}
+	if port == 0 {
+		return nil
+	}
+
+	labels := negLabels.Clone()
+	labels[promLabelNEGIP] = pmodel.LabelValue(endpoint.IpAddress)
+	labels[promLabelNEGPort] = pmodel.LabelValue(strconv.FormatInt(port, 10))
+	if endpoint.Instance != "" {
+		labels[promLabelNEGInstance] = pmodel.LabelValue(lastPathSegment(endpoint.Instance))
+	}
+
+	return &PromConfig{
+		Targets: []string{net.JoinHostPort(endpoint.IpAddress, strconv.FormatInt(port, 10))},
+		Labels:  labels,
+	}
+}
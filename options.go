@@ -0,0 +1,144 @@
+package gcppromd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// DefaultPresenceLabel is the GCE label identifying the instances scrapable by prometheus.
+	DefaultPresenceLabel = "prometheus"
+
+	// Address families of the targets
+	AddressFamilyIPv4 = "ipv4"
+	AddressFamilyIPv6 = "ipv6"
+
+	// Address modes of the targets
+	AddressModePrivate   = "private"
+	AddressModePublic    = "public"
+	AddressModeZonalDNS  = "zonal-dns"
+	AddressModeGlobalDNS = "global-dns"
+)
+
+var labelKeyRE = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+
+// DiscoveryOptions tunes how the resources are selected and turned into targets.
+type DiscoveryOptions struct {
+	// PresenceLabel is the GCE label an instance must carry to be discovered, DefaultPresenceLabel when empty.
+	PresenceLabel string
+	// PresenceValue is a RE2 regex the value of the presence label must match, any value when empty.
+	PresenceValue string
+	// DisablePresenceFilter discovers every instance, only the prometheus_ports* metadata then select the targets.
+	DisablePresenceFilter bool
+	// AddressFamily of the target addresses, AddressFamilyIPv4 or AddressFamilyIPv6, unless overridden by the
+	// prometheus_address_family* metadata of the instance. AddressFamilyIPv4 when empty.
+	AddressFamily string
+	// AddressMode of the targets, one of the AddressMode* constants, unless overridden by the
+	// prometheus_address_mode* metadata of the instance. AddressModePrivate when empty.
+	AddressMode string
+	// GKEPorts are the ports of the GKE nodes to scrape by name, DefaultGKEPorts when empty.
+	GKEPorts map[string]int
+	// CloudSQLExporter is the text/template, executed with a CloudSQLInstance, of the address of the exporter scraping
+	// a Cloud SQL instance. Required by SourceCloudSQL.
+	CloudSQLExporter string
+	// MemorystoreExporter is the text/template, executed with a MemorystoreInstance, of the address of the exporter
+	// scraping a Memorystore instance. Required by SourceMemorystore.
+	MemorystoreExporter string
+}
+
+// Validate checks the options.
+func (o DiscoveryOptions) Validate() error {
+	if o.PresenceLabel != "" && !labelKeyRE.MatchString(o.PresenceLabel) {
+		return fmt.Errorf("invalid presence label %q", o.PresenceLabel)
+	}
+	if _, err := regexp.Compile(o.PresenceValue); err != nil {
+		return fmt.Errorf("invalid presence value: %v", err)
+	}
+	switch o.AddressFamily {
+	case "", AddressFamilyIPv4, AddressFamilyIPv6:
+	default:
+		return fmt.Errorf("invalid address family %q, expected %q or %q", o.AddressFamily, AddressFamilyIPv4, AddressFamilyIPv6)
+	}
+	switch o.AddressMode {
+	case "", AddressModePrivate, AddressModePublic, AddressModeZonalDNS, AddressModeGlobalDNS:
+	default:
+		return fmt.Errorf("invalid address mode %q, expected one of %q, %q, %q or %q", o.AddressMode,
+			AddressModePrivate, AddressModePublic, AddressModeZonalDNS, AddressModeGlobalDNS)
+	}
+	for name, port := range o.GKEPorts {
+		if name == "" || port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid GKE port %s:%d", name, port)
+		}
+	}
+	if o.CloudSQLExporter != "" {
+		if _, err := parseExporterAddress("Cloud SQL", o.CloudSQLExporter, CloudSQLInstance{}); err != nil {
+			return err
+		}
+	}
+	if o.MemorystoreExporter != "" {
+		if _, err := parseExporterAddress("Memorystore", o.MemorystoreExporter, MemorystoreInstance{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o DiscoveryOptions) addressFamily() string {
+	if o.AddressFamily == "" {
+		return AddressFamilyIPv4
+	}
+	return o.AddressFamily
+}
+
+func (o DiscoveryOptions) presenceLabel() string {
+	if o.PresenceLabel == "" {
+		return DefaultPresenceLabel
+	}
+	return o.PresenceLabel
+}
+
+// presenceFilter returns the GCE API filter matching the instances carrying the presence label, in the regular
+// expressions syntax or not, see combineFilters. Without the regular expressions the presence value isn't filtered,
+// see matchesPresence.
+func (o DiscoveryOptions) presenceFilter(regexp bool) string {
+	if o.DisablePresenceFilter {
+		return ""
+	}
+	if !regexp {
+		return labelExistsFilter(o.presenceLabel(), false)
+	}
+	value := o.PresenceValue
+	if value == "" {
+		value = ".*"
+	}
+	if strings.ContainsAny(value, " \t()") {
+		value = `"` + value + `"`
+	}
+	return fmt.Sprintf("(labels.%s eq %s)", o.presenceLabel(), value)
+}
+
+// matchesPresence reports whether the labels of a resource listed without the presence filter, e.g. by an API that
+// doesn't support it, carry the presence label.
+func (o DiscoveryOptions) matchesPresence(labels map[string]string) bool {
+	if o.DisablePresenceFilter {
+		return true
+	}
+	value, ok := labels[o.presenceLabel()]
+	if !ok {
+		return false
+	}
+	if o.PresenceValue == "" {
+		return true
+	}
+	// the GCE API filters match the whole value
+	matched, err := regexp.MatchString("^(?:"+o.PresenceValue+")$", value)
+	return err == nil && matched
+}
+
+func (o DiscoveryOptions) addressMode() string {
+	if o.AddressMode == "" {
+		return AddressModePrivate
+	}
+	return o.AddressMode
+}
@@ -0,0 +1,195 @@
+package gcppromd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	crmv3 "google.golang.org/api/cloudresourcemanager/v3"
+)
+
+// Project is a project found by the projects auto-discovery.
+type Project struct {
+	ID     string
+	Labels map[string]string
+	// State is the lifecycle state of the project, e.g. ACTIVE or DELETE_REQUESTED
+	State string
+}
+
+// ValidateProjectsParent checks that parent is an organizations/<id> or folders/<id> projects parent.
+func ValidateProjectsParent(parent string) error {
+	for _, prefix := range []string{"organizations/", "folders/"} {
+		if strings.HasPrefix(parent, prefix) && len(parent) > len(prefix) && !strings.Contains(parent[len(prefix):], "/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid projects parent %q, expected organizations/<id> or folders/<id>", parent)
+}
+
+// walkParents returns the projects of the parents and of all their folders, recursively.
+func (d *GCPProjectDiscovery) walkParents(ctx context.Context, parents []string) ([]*Project, error) {
+	projects := make([]*Project, 0, 100)
+	seen := make(map[string]bool)
+	queue := append([]string(nil), parents...)
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+		if seen[parent] {
+			continue
+		}
+		seen[parent] = true
+
+		// the projects pending deletion are listed like Projects.List of v1 does, the states are filtered by the caller
+		preq := d.v3.Projects.List().Parent(parent).ShowDeleted(true)
+		if err := preq.Pages(ctx, func(page *crmv3.ListProjectsResponse) error {
+			for _, project := range page.Projects {
+				projects = append(projects, &Project{
+					ID:     project.ProjectId,
+					Labels: project.Labels,
+					State:  project.State,
+				})
+			}
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("listing the projects of %s: %v", parent, err)
+		}
+
+		freq := d.v3.Folders.List().Parent(parent)
+		if err := freq.Pages(ctx, func(page *crmv3.ListFoldersResponse) error {
+			for _, folder := range page.Folders {
+				queue = append(queue, folder.Name)
+			}
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("listing the folders of %s: %v", parent, err)
+		}
+	}
+	return projects, nil
+}
+
+// ProjectStateActive is the lifecycle state of the projects that are not pending deletion.
+const ProjectStateActive = "ACTIVE"
+
+// ProjectStates are the lifecycle states of the projects.
+var ProjectStates = []string{ProjectStateActive, "DELETE_REQUESTED", "DELETE_IN_PROGRESS"}
+
+// ParseProjectStates parses comma-separated lifecycle states, in any case, e.g. "active,delete_requested".
+func ParseProjectStates(raw string) ([]string, error) {
+	var states []string
+	for _, part := range strings.Split(raw, ",") {
+		state := strings.ToUpper(strings.TrimSpace(part))
+		if state == "" {
+			continue
+		}
+		known := false
+		for _, s := range ProjectStates {
+			known = known || s == state
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown project state %q, expected one of %s", part, strings.Join(ProjectStates, ", "))
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// LabelOperator is how a LabelSelector compares the labels of a project.
+type LabelOperator string
+
+const (
+	// LabelEquals selects the projects whose label has the value, key=value.
+	LabelEquals LabelOperator = "="
+	// LabelNotEquals selects the projects without the label or with another value, key!=value.
+	LabelNotEquals LabelOperator = "!="
+	// LabelExists selects the projects carrying the label, key.
+	LabelExists LabelOperator = ""
+	// LabelNotExists selects the projects not carrying the label, !key.
+	LabelNotExists LabelOperator = "!"
+)
+
+// LabelSelector selects the projects by their label Key.
+type LabelSelector struct {
+	Key      string
+	Operator LabelOperator
+	// Value compared by the LabelEquals and LabelNotEquals operators
+	Value string
+}
+
+// Matches reports whether labels match the selector.
+func (s LabelSelector) Matches(labels map[string]string) bool {
+	value, has := labels[s.Key]
+	switch s.Operator {
+	case LabelEquals:
+		return has && value == s.Value
+	case LabelNotEquals:
+		return !has || value != s.Value
+	case LabelNotExists:
+		return !has
+	default:
+		return has
+	}
+}
+
+// String returns the selector in the format parsed by ParseLabelSelectors.
+func (s LabelSelector) String() string {
+	switch s.Operator {
+	case LabelEquals, LabelNotEquals:
+		return s.Key + string(s.Operator) + s.Value
+	case LabelNotExists:
+		return "!" + s.Key
+	default:
+		return s.Key
+	}
+}
+
+// LabelSelectors select the projects matching all of them.
+type LabelSelectors []LabelSelector
+
+// ParseLabelSelectors parses comma-separated label selectors: <key>=<value>, <key>!=<value>, <key> for the projects
+// carrying the label and !<key> for the ones that don't, e.g. "env=prod,team!=sandbox,!temporary".
+func ParseLabelSelectors(raw string) (LabelSelectors, error) {
+	var selectors LabelSelectors
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var selector LabelSelector
+		switch {
+		case strings.Contains(part, "!="):
+			kv := strings.SplitN(part, "!=", 2)
+			selector = LabelSelector{Key: kv[0], Operator: LabelNotEquals, Value: kv[1]}
+		case strings.Contains(part, "="):
+			kv := strings.SplitN(part, "=", 2)
+			selector = LabelSelector{Key: kv[0], Operator: LabelEquals, Value: kv[1]}
+		case strings.HasPrefix(part, "!"):
+			selector = LabelSelector{Key: part[1:], Operator: LabelNotExists}
+		default:
+			selector = LabelSelector{Key: part, Operator: LabelExists}
+		}
+		if selector.Key == "" || strings.ContainsAny(selector.Key, "!= ") {
+			return nil, fmt.Errorf("invalid label selector %q, expected <key>=<value>, <key>!=<value>, <key> or !<key>", part)
+		}
+		selectors = append(selectors, selector)
+	}
+	return selectors, nil
+}
+
+// Matches reports whether labels match all the selectors.
+func (s LabelSelectors) Matches(labels map[string]string) bool {
+	for _, selector := range s {
+		if !selector.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the selectors in the format parsed by ParseLabelSelectors.
+func (s LabelSelectors) String() string {
+	parts := make([]string, 0, len(s))
+	for _, selector := range s {
+		parts = append(parts, selector.String())
+	}
+	return strings.Join(parts, ",")
+}
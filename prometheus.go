@@ -7,3 +7,11 @@ type PromConfig struct {
 	Targets []string        `json:"targets"`
 	Labels  pmodel.LabelSet `json:"labels"`
 }
+
+// CountTargets returns the number of targets declared by configs.
+func CountTargets(configs []*PromConfig) (n int) {
+	for _, c := range configs {
+		n += len(c.Targets)
+	}
+	return
+}
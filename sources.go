@@ -0,0 +1,153 @@
+package gcppromd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Discovery sources
+const (
+	SourceGCE         = "gce"
+	SourceGKE         = "gke"
+	SourceCloudSQL    = "cloudsql"
+	SourceMemorystore = "memorystore"
+	SourceLB          = "forwarding-rules"
+	SourceCloudRun    = "cloudrun"
+	SourceNEG         = "neg"
+	// SourceAssetInventory discovers the GCE instances of organizations or folders instead of projects
+	SourceAssetInventory = "asset-inventory"
+)
+
+// Sources lists the available discovery sources.
+var Sources = []string{SourceGCE, SourceGKE, SourceCloudSQL, SourceMemorystore, SourceLB, SourceCloudRun, SourceNEG, SourceAssetInventory}
+
+// ValidateSources checks that all the sources are known and that the options they require are set.
+func (o DiscoveryOptions) ValidateSources(sources []string) error {
+	for _, source := range sources {
+		known := false
+		for _, s := range Sources {
+			known = known || source == s
+		}
+		if !known {
+			return fmt.Errorf("unknown discovery source %q, expected one of %s", source, strings.Join(Sources, ", "))
+		}
+		if source == SourceCloudSQL && o.CloudSQLExporter == "" {
+			return fmt.Errorf("the %s source requires a Cloud SQL exporter address", source)
+		}
+		if source == SourceMemorystore && o.MemorystoreExporter == "" {
+			return fmt.Errorf("the %s source requires a Memorystore exporter address", source)
+		}
+	}
+	return nil
+}
+
+// ParseNamedPorts parses a comma separated list of <name>:<port> pairs.
+func ParseNamedPorts(raw string) (map[string]int, error) {
+	ports := make(map[string]int)
+	for _, pair := range strings.Split(raw, promSeparator) {
+		if pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid named port %q, expected <name>:<port>", pair)
+		}
+		port, err := strconv.Atoi(pair[i+1:])
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port in %q", pair)
+		}
+		ports[pair[:i]] = port
+	}
+	return ports, nil
+}
+
+// parseExporterAddress parses the text/template of the address of an exporter scraping the resources of a source,
+// it is executed once with data to catch the unknown fields before any resource is discovered.
+func parseExporterAddress(source, text string, data interface{}) (*template.Template, error) {
+	if text == "" {
+		return nil, fmt.Errorf("no %s exporter address configured", source)
+	}
+	exporter, err := template.New(source).Option("missingkey=error").Parse(text)
+	if err == nil {
+		err = exporter.Execute(ioutil.Discard, data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s exporter address: %v", source, err)
+	}
+	return exporter, nil
+}
+
+// executeExporterAddress returns the address of the exporter scraping a resource.
+func executeExporterAddress(exporter *template.Template, data interface{}) (string, error) {
+	addr := &bytes.Buffer{}
+	if err := exporter.Execute(addr, data); err != nil {
+		return "", err
+	}
+	return addr.String(), nil
+}
+
+// discoverers holds the discovery of every source.
+type discoverers struct {
+	gce         *GCEDiscovery
+	gke         *GKEDiscovery
+	cloudsql    *CloudSQLDiscovery
+	memorystore *MemorystoreDiscovery
+	cloudrun    *CloudRunDiscovery
+	asset       *AssetDiscovery
+}
+
+func newDiscoverers() (*discoverers, error) {
+	gced, err := NewGCEDiscovery()
+	if err != nil {
+		return nil, err
+	}
+	gked, err := NewGKEDiscovery()
+	if err != nil {
+		return nil, err
+	}
+	sqld, err := NewCloudSQLDiscovery()
+	if err != nil {
+		return nil, err
+	}
+	redisd, err := NewMemorystoreDiscovery()
+	if err != nil {
+		return nil, err
+	}
+	rund, err := NewCloudRunDiscovery()
+	if err != nil {
+		return nil, err
+	}
+	assetd, err := NewAssetDiscovery()
+	if err != nil {
+		return nil, err
+	}
+	return &discoverers{gce: gced, gke: gked, cloudsql: sqld, memorystore: redisd, cloudrun: rund, asset: assetd}, nil
+}
+
+// discover runs the discovery of a request with the discovery of its source.
+func (d *discoverers) discover(ctx context.Context, req *GCEReqInstanceDiscovery) ([]*PromConfig, error) {
+	switch req.Source {
+	case "", SourceGCE:
+		return d.gce.Instances(ctx, req.Project, req.Filter, req.Options)
+	case SourceGKE:
+		return d.gke.Nodes(ctx, req.Project, req.Filter, req.Options)
+	case SourceCloudSQL:
+		return d.cloudsql.Instances(ctx, req.Project, req.Options)
+	case SourceMemorystore:
+		return d.memorystore.Instances(ctx, req.Project, req.Options)
+	case SourceLB:
+		return d.gce.ForwardingRules(ctx, req.Project, req.Options)
+	case SourceCloudRun:
+		return d.cloudrun.Services(ctx, req.Project, req.Options)
+	case SourceNEG:
+		return d.gce.NetworkEndpoints(ctx, req.Project, req.Options)
+	case SourceAssetInventory:
+		return d.asset.Instances(ctx, req.Project, req.Options)
+	}
+	return nil, fmt.Errorf("unknown discovery source %q", req.Source)
+}